@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// accountResponse describes state of our account in the portal.
+type accountResponse struct {
+	stalker.AccountInfo
+	Session      string    `json:"session"`
+	SessionSince time.Time `json:"session_since"`
+	SessionError string    `json:"session_error,omitempty"`
+	ExpiresSoon  bool      `json:"expires_soon"`
+}
+
+// handleAccountJSON returns subscription details and session state as JSON.
+func handleAccountJSON(w http.ResponseWriter, r *http.Request) {
+	state, since, err := config.Portal.State()
+	resp := accountResponse{
+		AccountInfo:  config.Portal.AccountInfo(),
+		Session:      state.String(),
+		SessionSince: since,
+	}
+	if err != nil {
+		resp.SessionError = err.Error()
+	}
+	resp.ExpiresSoon = resp.AccountInfo.ExpiresSoon()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
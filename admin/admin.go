@@ -6,8 +6,10 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/CrazeeGhost/stalkerhek/proxy"
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -21,6 +23,9 @@ var config *stalker.Config
 // configPath stores the path to the YAML configuration file on disk.
 var configPath string
 
+// proxyServer is the running proxy service, or nil if it is disabled.
+var proxyServer *proxy.Server
+
 // Start launches a lightweight administrative HTTP server that exposes
 // endpoints for inspecting and editing the Stalker portal configuration and
 // restarting the application.  The server runs until the application exits.
@@ -30,14 +35,20 @@ var configPath string
 //      when users submit changes via the web form.
 //   path: filesystem path to the YAML configuration file.  Updated
 //         configurations are written back to this file.
-func Start(c *stalker.Config, path string) {
+//   px: running proxy service whose connected STBs are shown, or nil.
+func Start(c *stalker.Config, path string, px *proxy.Server) {
     config = c
     configPath = path
+    proxyServer = px
 
     mux := http.NewServeMux()
     mux.HandleFunc("/", handleConfig)
     mux.HandleFunc("/config", handleConfig)
     mux.HandleFunc("/restart", handleRestart)
+    mux.HandleFunc("/stbs", handleSTBs)
+    mux.HandleFunc("/api/stbs", handleSTBsJSON)
+    mux.HandleFunc("/api/account", handleAccountJSON)
+    mux.HandleFunc("/proxy/cache", handleProxyCache)
 
     server := &http.Server{
         Addr:              c.Admin.Bind,
@@ -63,8 +74,51 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
     case http.MethodGet:
         w.Header().Set("Content-Type", "text/html; charset=utf-8")
         // Render simple HTML form with current configuration values.
-        fmt.Fprintf(w, "<html><body><h2>Stalker Portal Configuration</h2><form method=\"POST\" action=\"/config\">")
+        fmt.Fprintf(w, "<html><body><h2>Stalker Portal Configuration</h2>")
+        // Current state of the session with the portal
+        state, since, err := config.Portal.State()
+        fmt.Fprintf(w, "<p>Session: <b>%s</b> since %s", state, since.Format("2006-01-02 15:04:05"))
+        if err != nil {
+            fmt.Fprintf(w, " (%s)", html.EscapeString(err.Error()))
+        }
+        fmt.Fprintf(w, "</p>")
+        // Profile of our account, as reported by the portal
+        if profile := config.Portal.Profile(); !profile.Updated.IsZero() {
+            fmt.Fprintf(w, "<p>Account: <b>%s</b> (ID %s), tariff plan %s, status %d, watchdog timeout %ds",
+                html.EscapeString(profile.Name), html.EscapeString(profile.ID), html.EscapeString(profile.TariffPlan), profile.Status, profile.WatchdogTimeout)
+            if profile.Blocked {
+                fmt.Fprintf(w, ", <b>blocked</b>")
+            }
+            fmt.Fprintf(w, "</p>")
+        }
+        // Subscription of our account
+        if account := config.Portal.AccountInfo(); !account.Updated.IsZero() {
+            fmt.Fprintf(w, "<p>Subscription: tariff plan <b>%s</b>", html.EscapeString(account.TariffPlan))
+            if left, expires := account.ExpiresIn(); expires {
+                expiry := fmt.Sprintf("expires %s (%d days left)", account.EndDate.Format("2006-01-02 15:04"), int(left.Hours()/24))
+                if left <= 0 {
+                    expiry = "expired " + account.EndDate.Format("2006-01-02 15:04")
+                }
+                if account.ExpiresSoon() {
+                    expiry = "<b style=\"color:red\">" + expiry + "</b>"
+                }
+                fmt.Fprintf(w, ", %s", expiry)
+            } else if account.EndDateRaw != "" {
+                fmt.Fprintf(w, ", valid until %s", html.EscapeString(account.EndDateRaw))
+            }
+            fmt.Fprintf(w, " <a href=\"/api/account\">JSON</a></p>")
+        }
+        // Messages pushed by the portal
+        if messages := config.Portal.Messages(); len(messages) != 0 {
+            fmt.Fprintf(w, "<h3>Portal messages</h3><ul>")
+            for _, m := range messages {
+                fmt.Fprintf(w, "<li>%s: %s</li>", m.Time.Format("2006-01-02 15:04:05"), html.EscapeString(m.Message))
+            }
+            fmt.Fprintf(w, "</ul>")
+        }
+        fmt.Fprintf(w, "<form method=\"POST\" action=\"/config\">")
         fmt.Fprintf(w, "Model: <input name=\"model\" value=\"%s\"><br>", config.Portal.Model)
+        fmt.Fprintf(w, "Device profile: <input name=\"device\" value=\"%s\"> (%s, empty to pick by model)<br>", html.EscapeString(config.Portal.DeviceName), strings.Join(stalker.DeviceNames(), ", "))
         fmt.Fprintf(w, "Serial Number: <input name=\"serial_number\" value=\"%s\"><br>", config.Portal.SerialNumber)
         fmt.Fprintf(w, "Device ID: <input name=\"device_id\" value=\"%s\"><br>", config.Portal.DeviceID)
         fmt.Fprintf(w, "Device ID2: <input name=\"device_id2\" value=\"%s\"><br>", config.Portal.DeviceID2)
@@ -88,6 +142,7 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
         fmt.Fprintf(w, "<input type=\"submit\" value=\"Save\"></form>")
         // Separate form for restart button
         fmt.Fprintf(w, "<form method=\"POST\" action=\"/restart\"><input type=\"submit\" value=\"Restart\"></form>")
+        fmt.Fprintf(w, "<p><a href=\"/stbs\">Connected STBs</a></p>")
         fmt.Fprintf(w, "</body></html>")
     case http.MethodPost:
         // Apply posted values to configuration
@@ -97,6 +152,7 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
         }
         // Update portal fields from form values
         config.Portal.Model = r.FormValue("model")
+        config.Portal.DeviceName = r.FormValue("device")
         config.Portal.SerialNumber = r.FormValue("serial_number")
         config.Portal.DeviceID = r.FormValue("device_id")
         config.Portal.DeviceID2 = r.FormValue("device_id2")
@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// handleSTBs renders STBs connected to the proxy service and handles block,
+// unblock and kick actions submitted from that page.
+func handleSTBs(w http.ResponseWriter, r *http.Request) {
+	if proxyServer == nil {
+		http.Error(w, "proxy service is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><body><h2>Connected STBs</h2>")
+		fmt.Fprintf(w, "<table border=\"1\" cellpadding=\"4\"><tr><th>IP</th><th>MAC</th><th>Serial</th><th>User Agent</th><th>Last action</th><th>Channel</th><th>Last seen</th><th>Requests</th><th></th></tr>")
+		for _, s := range proxyServer.Sessions().List() {
+			toggle := "block"
+			if s.Blocked {
+				toggle = "unblock"
+			}
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s ago</td><td>%d</td><td>",
+				html.EscapeString(s.IP), html.EscapeString(s.MAC), html.EscapeString(s.SerialNumber), html.EscapeString(s.UserAgent),
+				html.EscapeString(s.LastAction), html.EscapeString(s.Channel), time.Since(s.LastSeen).Round(time.Second), s.Requests)
+			for _, action := range []string{toggle, "kick"} {
+				fmt.Fprintf(w, "<form method=\"POST\" action=\"/stbs\" style=\"display:inline\"><input type=\"hidden\" name=\"key\" value=\"%s\"><input type=\"hidden\" name=\"action\" value=\"%s\"><input type=\"submit\" value=\"%s\"></form>",
+					html.EscapeString(s.Key), action, action)
+			}
+			fmt.Fprintf(w, "</td></tr>")
+		}
+		fmt.Fprintf(w, "</table>")
+		fmt.Fprintf(w, "<form method=\"POST\" action=\"/proxy/cache\"><input type=\"submit\" value=\"Clear proxy cache\"></form>")
+		fmt.Fprintf(w, "<p><a href=\"/\">Back</a></p></body></html>")
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		key := r.FormValue("key")
+		var found bool
+		switch r.FormValue("action") {
+		case "block":
+			found = proxyServer.Sessions().SetBlocked(key, true)
+		case "unblock":
+			found = proxyServer.Sessions().SetBlocked(key, false)
+		case "kick":
+			found = proxyServer.Sessions().Kick(key)
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "unknown STB "+url.QueryEscape(key), http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/stbs", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSTBsJSON returns STBs connected to the proxy service as JSON.
+func handleSTBsJSON(w http.ResponseWriter, r *http.Request) {
+	if proxyServer == nil {
+		http.Error(w, "proxy service is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(proxyServer.Sessions().List())
+}
+
+// handleProxyCache drops portal responses cached by the proxy service, so STBs get fresh channel lists.
+func handleProxyCache(w http.ResponseWriter, r *http.Request) {
+	if proxyServer == nil {
+		http.Error(w, "proxy service is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n := proxyServer.InvalidateCache()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body>Dropped %d cached responses.<br><a href=\"/stbs\">Back</a></body></html>", n)
+}
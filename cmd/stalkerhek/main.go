@@ -1,13 +1,17 @@
 package main
 
 import (
+    "errors"
     "flag"
     "log"
     "sync"
+    "time"
 
+    "github.com/CrazeeGhost/stalkerhek/dlna"
     "github.com/CrazeeGhost/stalkerhek/hls"
     "github.com/CrazeeGhost/stalkerhek/proxy"
     "github.com/CrazeeGhost/stalkerhek/stalker"
+    "github.com/CrazeeGhost/stalkerhek/strm"
     // Import the admin package which exposes a small web UI for editing
     // configuration and restarting the application.  This package is
     // conditionally started based on the configuration contained in
@@ -16,6 +20,11 @@ import (
 )
 
 var flagConfig = flag.String("config", "stalkerhek.yml", "path to the config file")
+var flagExportSTRM = flag.Bool("export-strm", false, "export VOD library as .strm files (see 'strm' config section) and exit")
+
+// Channels that are currently served. They are replaced only by refreshChannels.
+var currentChannels map[string]*stalker.Channel
+var currentChannelsMux sync.Mutex
 
 func main() {
 	// Change flags on the default logger, so it print's line numbers as well.
@@ -29,42 +38,173 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	var wg sync.WaitGroup
+
+	if c.Emulator.Enabled {
+		emulator, err := proxy.NewEmulator(c)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		wg.Add(1)
+		go func() {
+			log.Println("Starting portal emulator...")
+			emulator.Start(c.Emulator.Bind)
+			wg.Done()
+		}()
+	}
+
+	// Portal emulator runs on its own
+	if c.Portal == nil {
+		wg.Wait()
+		return
+	}
+
+	// Report session problems instead of dying on them
+	c.Portal.OnStateChange(func(sc stalker.StateChange) {
+		if sc.Err != nil {
+			log.Println("Stalker session is "+sc.To.String()+":", sc.Err)
+		} else {
+			log.Println("Stalker session is " + sc.To.String())
+		}
+	})
+
+	// Portal asks STBs to reload channels when it changes them. Registered before the session is started, as the
+	// event may come with the very first watchdog update. Channels are refreshed once services are running.
+	channelsChanged := make(chan struct{}, 1)
+	c.Portal.OnEvent(func(e stalker.Event) {
+		if e.Type != stalker.EventUpdateChannelList {
+			return
+		}
+		select {
+		case channelsChanged <- struct{}{}:
+		default:
+			// Refresh is pending already
+		}
+	})
+
+	// Session and channels of the previous run, used while portal is unavailable
+	cached, err := c.Portal.LoadState()
+	if err != nil {
+		log.Println("Failed to load state file:", err)
+	}
+
 	// Authenticate (connect) to Stalker portal and keep-alive it's connection.
 	log.Println("Connecting to Stalker middleware...")
+	offline := false
 	if err = c.Portal.Start(); err != nil {
-		log.Fatalln(err)
+		if len(cached) == 0 || *flagExportSTRM {
+			log.Fatalln(err)
+		}
+		log.Println("Serving channels from state file until session with Stalker portal is re-established:", err)
+		offline = true
 	}
 
-	// Retrieve channels list.
-	log.Println("Retrieving channels list from Stalker middleware...")
-	channels, err := c.Portal.RetrieveChannels()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	if len(channels) == 0 {
-		log.Fatalln("no IPTV channels retrieved from Stalker middleware. quitting...")
+	// One-off VOD library export
+	if *flagExportSTRM {
+		if c.STRM.Dir == "" || c.STRM.BaseURL == "" {
+			log.Fatalln("'strm' config section must be enabled and configured to export .strm files")
+		}
+		if err = strm.Export(c); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
 
-	var wg sync.WaitGroup
+	// Retrieve channels list.
+	channels := cached
+	if !offline {
+		log.Println("Retrieving channels list from Stalker middleware...")
+		retrieved, err := c.Portal.RetrieveChannels()
+		switch {
+		case err == nil && len(retrieved) != 0:
+			channels = retrieved
+			if err = c.Portal.RememberChannels(channels); err != nil {
+				log.Println("Failed to save state file:", err)
+			}
+		case len(cached) == 0 && err != nil:
+			log.Fatalln(err)
+		case len(cached) == 0:
+			log.Fatalln("no IPTV channels retrieved from Stalker middleware. quitting...")
+		default:
+			log.Println("Failed to retrieve channels list, serving channels from state file:", err)
+			offline = true
+		}
+	}
+	c.Portal.AddCustomChannels(channels, c.CustomChannels)
+	currentChannels = channels
 
 	if c.HLS.Enabled {
 		wg.Add(1)
 		go func() {
 			log.Println("Starting HLS service...")
-			hls.Start(channels, c.HLS.Bind)
+			hls.Start(c, channels)
 			wg.Done()
 		}()
 	}
 
+	var proxyServer *proxy.Server
 	if c.Proxy.Enabled {
+		if proxyServer, err = proxy.NewServer(c, channels); err != nil {
+			log.Fatalln(err)
+		}
 		wg.Add(1)
 		go func() {
 			log.Println("Starting proxy service...")
-			proxy.Start(c, channels)
+			proxyServer.Start(c.Proxy.Bind)
+			wg.Done()
+		}()
+	}
+
+	// Channels from state file are replaced as soon as portal gives them
+	if offline {
+		authenticated := make(chan struct{}, 1)
+		c.Portal.OnStateChange(func(sc stalker.StateChange) {
+			if sc.To != stalker.StateAuthenticated {
+				return
+			}
+			select {
+			case authenticated <- struct{}{}:
+			default:
+			}
+		})
+		go refreshUntilOnline(c, proxyServer, authenticated)
+	}
+
+	// Providers add and remove channels without telling
+	if c.Portal.ChannelRefresh > 0 {
+		go func() {
+			for range time.Tick(time.Duration(c.Portal.ChannelRefresh) * time.Minute) {
+				if err := refreshChannels(c, proxyServer); err != nil {
+					log.Println("Failed to update channel list:", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range channelsChanged {
+			if err := refreshChannels(c, proxyServer); err != nil {
+				log.Println("Failed to update channel list:", err)
+			}
+		}
+	}()
+
+	if c.DLNA.Enabled {
+		wg.Add(1)
+		go func() {
+			log.Println("Starting DLNA service...")
+			dlna.Start(c)
 			wg.Done()
 		}()
 	}
 
+	if c.STRM.Enabled {
+		go func() {
+			log.Println("Starting STRM export...")
+			strm.Start(c)
+		}()
+	}
+
     // Start the administration GUI if enabled.  This runs in its own
     // goroutine so that the main thread can continue to manage the other
     // services.  The admin service exposes a simple HTML form at /config
@@ -75,10 +215,72 @@ func main() {
         wg.Add(1)
         go func() {
             log.Println("Starting admin service...")
-            admin.Start(c, *flagConfig)
+            admin.Start(c, *flagConfig, proxyServer)
             wg.Done()
         }()
     }
 
 	wg.Wait()
 }
+
+// Retries of replacing channels from state file start with offlineRetryMin and back off up to offlineRetryMax.
+const (
+	offlineRetryMin = 10 * time.Second
+	offlineRetryMax = 5 * time.Minute
+)
+
+// refreshUntilOnline replaces channels served from state file with the ones of Stalker portal, retrying with backoff
+// until it succeeds. A retry is made right away whenever session is (re-)established.
+func refreshUntilOnline(c *stalker.Config, proxyServer *proxy.Server, authenticated <-chan struct{}) {
+	delay := offlineRetryMin
+	for {
+		if state, _, _ := c.Portal.State(); state == stalker.StateAuthenticated {
+			err := refreshChannels(c, proxyServer)
+			if err == nil {
+				return
+			}
+			log.Println("Failed to update channel list, retrying in "+delay.String()+":", err)
+		}
+		select {
+		case <-authenticated:
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > offlineRetryMax {
+			delay = offlineRetryMax
+		}
+	}
+}
+
+// refreshChannels retrieves channels from Stalker portal again and, if they have changed, hands them over to running
+// services. Channels that did not change keep streaming.
+func refreshChannels(c *stalker.Config, proxyServer *proxy.Server) error {
+	currentChannelsMux.Lock()
+	defer currentChannelsMux.Unlock()
+
+	channels, err := c.Portal.RetrieveChannels()
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return errors.New("no IPTV channels retrieved from Stalker middleware")
+	}
+	diff := stalker.DiffChannels(currentChannels, channels)
+	if diff.Empty() {
+		log.Println("Channel list is up to date")
+		return nil
+	}
+	if err = c.Portal.RememberChannels(channels); err != nil {
+		log.Println("Failed to save state file:", err)
+	}
+	c.Portal.AddCustomChannels(channels, c.CustomChannels)
+
+	if c.HLS.Enabled {
+		hls.UpdateChannels(channels)
+	}
+	if proxyServer != nil {
+		proxyServer.UpdateChannels(channels)
+	}
+	currentChannels = channels
+	log.Println("Channel list updated:", diff)
+	return nil
+}
@@ -0,0 +1,391 @@
+package dlna
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+const (
+	deviceType                = "urn:schemas-upnp-org:device:MediaServer:1"
+	contentDirectoryService   = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManagerService  = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	rootObjectID              = "0"
+	genreObjectPrefix         = "genre/"
+	channelObjectPrefix       = "channel/"
+	protocolInfoMPEGTS        = "http-get:*:video/mp2t:DLNA.ORG_OP=00;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+	protocolInfoHLS           = "http-get:*:application/vnd.apple.mpegurl:*"
+	sourceProtocolInfo        = protocolInfoMPEGTS + "," + protocolInfoHLS
+	descriptionPath           = "/description.xml"
+	contentDirectorySCPDPath  = "/ContentDirectory.xml"
+	connectionManagerSCPDPath = "/ConnectionManager.xml"
+)
+
+var config *stalker.Config
+
+// udn is a unique device name, stable across restarts.
+var udn string
+
+// Start starts UPnP MediaServer: SSDP announcements and ContentDirectory service.
+func Start(c *stalker.Config) {
+	config = c
+
+	hostname, _ := os.Hostname()
+	sum := md5.Sum([]byte(hostname + c.DLNA.FriendlyName + c.DLNA.Bind))
+	udn = fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+
+	_, port, err := net.SplitHostPort(c.DLNA.Bind)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go startSSDP(port)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(descriptionPath, descriptionHandler)
+	mux.HandleFunc(contentDirectorySCPDPath, scpdHandler(contentDirectorySCPD))
+	mux.HandleFunc(connectionManagerSCPDPath, scpdHandler(connectionManagerSCPD))
+	mux.HandleFunc("/control/ContentDirectory", contentDirectoryHandler)
+	mux.HandleFunc("/control/ConnectionManager", connectionManagerHandler)
+	mux.HandleFunc("/event/", eventHandler)
+
+	log.Println("DLNA service should be started!")
+	server := &http.Server{
+		Addr:              c.DLNA.Bind,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// localHost returns IP address of this host that the client has connected to.
+func localHost(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+	}
+	host, _, _ := net.SplitHostPort(r.Host)
+	return host
+}
+
+// hlsBase returns HLS service address that the client should be able to reach.
+func hlsBase(r *http.Request) string {
+	_, port, _ := net.SplitHostPort(config.HLS.Bind)
+	return "http://" + net.JoinHostPort(localHost(r), port)
+}
+
+func descriptionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>%s</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>Stalkerhek</manufacturer>
+    <modelName>Stalkerhek</modelName>
+    <UDN>%s</UDN>
+    <dlna:X_DLNADOC xmlns:dlna="urn:schemas-dlna-org:device-1-0">DMS-1.50</dlna:X_DLNADOC>
+    <serviceList>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>%s</SCPDURL>
+        <controlURL>/control/ContentDirectory</controlURL>
+        <eventSubURL>/event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>%s</SCPDURL>
+        <controlURL>/control/ConnectionManager</controlURL>
+        <eventSubURL>/event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`, deviceType, html.EscapeString(config.DLNA.FriendlyName), udn, contentDirectoryService, contentDirectorySCPDPath, connectionManagerService, connectionManagerSCPDPath)
+}
+
+func scpdHandler(scpd string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, scpd)
+	}
+}
+
+// Some TVs refuse to browse unless event subscription succeeds. No events are actually sent.
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = udn + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-1800")
+		w.WriteHeader(http.StatusOK)
+	case "UNSUBSCRIBE":
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// soapAction returns requested action name from 'SOAPACTION: "urn:...:1#Browse"' header.
+func soapAction(r *http.Request) string {
+	action := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+	if i := strings.LastIndex(action, "#"); i != -1 {
+		return action[i+1:]
+	}
+	return action
+}
+
+func writeSOAP(w http.ResponseWriter, service, action string, args [][2]string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	var sb strings.Builder
+	for _, arg := range args {
+		sb.WriteString("<" + arg[0] + ">" + html.EscapeString(arg[1]) + "</" + arg[0] + ">")
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, service, sb.String(), action)
+}
+
+func writeSOAPError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		code, html.EscapeString(description))
+}
+
+func connectionManagerHandler(w http.ResponseWriter, r *http.Request) {
+	switch soapAction(r) {
+	case "GetProtocolInfo":
+		writeSOAP(w, connectionManagerService, "GetProtocolInfo", [][2]string{{"Source", sourceProtocolInfo}, {"Sink", ""}})
+	case "GetCurrentConnectionIDs":
+		writeSOAP(w, connectionManagerService, "GetCurrentConnectionIDs", [][2]string{{"ConnectionIDs", "0"}})
+	default:
+		writeSOAPError(w, 401, "Invalid Action")
+	}
+}
+
+// browseRequest holds arguments of ContentDirectory's Browse action.
+type browseRequest struct {
+	ObjectID       string `xml:"Body>Browse>ObjectID"`
+	BrowseFlag     string `xml:"Body>Browse>BrowseFlag"`
+	StartingIndex  int    `xml:"Body>Browse>StartingIndex"`
+	RequestedCount int    `xml:"Body>Browse>RequestedCount"`
+}
+
+func contentDirectoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch soapAction(r) {
+	case "Browse":
+		var req browseRequest
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeSOAPError(w, 402, "Invalid Args")
+			return
+		}
+		browse(w, r, &req)
+	case "GetSearchCapabilities":
+		writeSOAP(w, contentDirectoryService, "GetSearchCapabilities", [][2]string{{"SearchCaps", ""}})
+	case "GetSortCapabilities":
+		writeSOAP(w, contentDirectoryService, "GetSortCapabilities", [][2]string{{"SortCaps", ""}})
+	case "GetSystemUpdateID":
+		writeSOAP(w, contentDirectoryService, "GetSystemUpdateID", [][2]string{{"Id", "1"}})
+	default:
+		writeSOAPError(w, 401, "Invalid Action")
+	}
+}
+
+// genres returns channels grouped by genre and sorted genre titles.
+func genres(channels []hls.ChannelInfo) (map[string][]hls.ChannelInfo, []string) {
+	byGenre := make(map[string][]hls.ChannelInfo)
+	titles := make([]string, 0)
+	for _, c := range channels {
+		if _, ok := byGenre[c.Genre]; !ok {
+			titles = append(titles, c.Genre)
+		}
+		byGenre[c.Genre] = append(byGenre[c.Genre], c)
+	}
+	sort.Strings(titles)
+	return byGenre, titles
+}
+
+func browse(w http.ResponseWriter, r *http.Request, req *browseRequest) {
+	byGenre, genreTitles := genres(hls.Channels())
+	base := hlsBase(r)
+
+	var objects []string
+	switch {
+	case req.ObjectID == rootObjectID && req.BrowseFlag == "BrowseMetadata":
+		objects = []string{containerDIDL(rootObjectID, "-1", config.DLNA.FriendlyName, len(genreTitles))}
+	case req.ObjectID == rootObjectID:
+		for _, g := range genreTitles {
+			objects = append(objects, containerDIDL(genreObjectPrefix+url.PathEscape(g), rootObjectID, g, len(byGenre[g])))
+		}
+	case strings.HasPrefix(req.ObjectID, genreObjectPrefix):
+		genre, err := url.PathUnescape(strings.TrimPrefix(req.ObjectID, genreObjectPrefix))
+		channels, ok := byGenre[genre]
+		if err != nil || !ok {
+			writeSOAPError(w, 701, "No such object")
+			return
+		}
+		if req.BrowseFlag == "BrowseMetadata" {
+			objects = []string{containerDIDL(req.ObjectID, rootObjectID, genre, len(channels))}
+			break
+		}
+		for _, c := range channels {
+			objects = append(objects, itemDIDL(base, req.ObjectID, c))
+		}
+	case strings.HasPrefix(req.ObjectID, channelObjectPrefix):
+		title, err := url.PathUnescape(strings.TrimPrefix(req.ObjectID, channelObjectPrefix))
+		if err != nil || req.BrowseFlag != "BrowseMetadata" {
+			writeSOAPError(w, 701, "No such object")
+			return
+		}
+		for g, channels := range byGenre {
+			for _, c := range channels {
+				if c.Title == title {
+					objects = []string{itemDIDL(base, genreObjectPrefix+url.PathEscape(g), c)}
+				}
+			}
+		}
+		if objects == nil {
+			writeSOAPError(w, 701, "No such object")
+			return
+		}
+	default:
+		writeSOAPError(w, 701, "No such object")
+		return
+	}
+
+	total := len(objects)
+	from := req.StartingIndex
+	if from < 0 || from > total {
+		from = total
+	}
+	to := total
+	if req.RequestedCount > 0 && from+req.RequestedCount < total {
+		to = from + req.RequestedCount
+	}
+	objects = objects[from:to]
+
+	result := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">` +
+		strings.Join(objects, "") + `</DIDL-Lite>`
+	writeSOAP(w, contentDirectoryService, "Browse", [][2]string{
+		{"Result", result},
+		{"NumberReturned", strconv.Itoa(len(objects))},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", "1"},
+	})
+}
+
+func containerDIDL(id, parentID, title string, childCount int) string {
+	return `<container id="` + html.EscapeString(id) + `" parentID="` + html.EscapeString(parentID) + `" restricted="1" childCount="` + strconv.Itoa(childCount) + `">` +
+		`<dc:title>` + html.EscapeString(title) + `</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`
+}
+
+func itemDIDL(base, parentID string, c hls.ChannelInfo) string {
+	// Unknown streams are offered in both formats, so renderers pick the one they support
+	var protocols []string
+	switch c.LinkType {
+	case "hls":
+		protocols = []string{protocolInfoHLS}
+	case "media":
+		protocols = []string{protocolInfoMPEGTS}
+	default:
+		protocols = []string{protocolInfoMPEGTS, protocolInfoHLS}
+	}
+	item := `<item id="` + html.EscapeString(channelObjectPrefix+url.PathEscape(c.Title)) + `" parentID="` + html.EscapeString(parentID) + `" restricted="1">` +
+		`<dc:title>` + html.EscapeString(c.Title) + `</dc:title><upnp:class>object.item.videoItem.videoBroadcast</upnp:class>` +
+		`<upnp:genre>` + html.EscapeString(c.Genre) + `</upnp:genre>`
+	if c.LogoPath != "" {
+		item += `<upnp:albumArtURI>` + html.EscapeString(base+c.LogoPath) + `</upnp:albumArtURI>`
+	}
+	for _, protocolInfo := range protocols {
+		item += `<res protocolInfo="` + protocolInfo + `">` + html.EscapeString(base+c.Path) + `</res>`
+	}
+	return item + `</item>`
+}
+
+const contentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType><allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const connectionManagerSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetProtocolInfo</name><argumentList>
+      <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+      <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionIDs</name><argumentList>
+      <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
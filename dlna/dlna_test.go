@@ -0,0 +1,30 @@
+package dlna
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+)
+
+func TestItemDIDLProtocolInfo(t *testing.T) {
+	tests := []struct {
+		linkType string
+		want     []string
+	}{
+		{"hls", []string{protocolInfoHLS}},
+		{"media", []string{protocolInfoMPEGTS}},
+		{"unknown", []string{protocolInfoMPEGTS, protocolInfoHLS}},
+	}
+	for _, tt := range tests {
+		item := itemDIDL("http://host", "0", hls.ChannelInfo{Title: "A", Path: "/iptv/A", LinkType: tt.linkType})
+		if n := strings.Count(item, "<res "); n != len(tt.want) {
+			t.Errorf("%s: got %d resources, want %d", tt.linkType, n, len(tt.want))
+		}
+		for _, protocolInfo := range tt.want {
+			if !strings.Contains(item, `protocolInfo="`+protocolInfo+`"`) {
+				t.Errorf("%s: missing %q", tt.linkType, protocolInfo)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ssdpAddr          = "239.255.255.250:1900"
+	ssdpMaxAge        = 1800
+	ssdpServer        = "Linux/1.0 UPnP/1.0 Stalkerhek/1.0"
+	ssdpNotifyEvery   = 5 * time.Minute
+	ssdpRootDeviceNT  = "upnp:rootdevice"
+	ssdpSearchAllNT   = "ssdp:all"
+	ssdpAliveSubtype  = "ssdp:alive"
+	ssdpDiscoverValue = `"ssdp:discover"`
+)
+
+// ssdpTargets returns notification types this device announces.
+func ssdpTargets() []string {
+	return []string{ssdpRootDeviceNT, udn, deviceType, contentDirectoryService, connectionManagerService}
+}
+
+// ssdpUSN returns unique service name for the given notification type.
+func ssdpUSN(nt string) string {
+	if nt == udn {
+		return udn
+	}
+	return udn + "::" + nt
+}
+
+// startSSDP answers M-SEARCH requests and periodically announces the device.
+func startSSDP(port string) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("SSDP disabled, failed to join multicast group:", err)
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		for {
+			notifyAlive(group, port)
+			time.Sleep(ssdpNotifyEvery)
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("SSDP read failed:", err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != ssdpDiscoverValue {
+			continue
+		}
+		go answerSearch(from, req.Header.Get("ST"), port)
+	}
+}
+
+// answerSearch sends unicast responses for every matching search target.
+func answerSearch(to *net.UDPAddr, st, port string) {
+	conn, err := net.DialUDP("udp4", nil, to)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	location := locationFor(conn, port)
+
+	for _, nt := range ssdpTargets() {
+		if st != ssdpSearchAllNT && st != nt {
+			continue
+		}
+		msg := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+			"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"SERVER: " + ssdpServer + "\r\n" +
+			"ST: " + nt + "\r\n" +
+			"USN: " + ssdpUSN(nt) + "\r\n" +
+			"Content-Length: 0\r\n\r\n"
+		conn.Write([]byte(msg))
+	}
+}
+
+// notifyAlive multicasts 'ssdp:alive' announcements.
+func notifyAlive(group *net.UDPAddr, port string) {
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("SSDP notify failed:", err)
+		return
+	}
+	defer conn.Close()
+	location := locationFor(conn, port)
+
+	for _, nt := range ssdpTargets() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: " + ssdpAliveSubtype + "\r\n" +
+			"SERVER: " + ssdpServer + "\r\n" +
+			"USN: " + ssdpUSN(nt) + "\r\n\r\n"
+		conn.Write([]byte(msg))
+	}
+}
+
+// locationFor returns device description URL, using local address of the connection as host.
+func locationFor(conn *net.UDPConn, port string) string {
+	host := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	return "http://" + net.JoinHostPort(host, port) + descriptionPath
+}
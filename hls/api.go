@@ -0,0 +1,215 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultPerPage = 100
+	apiMaxPerPage     = 1000
+)
+
+// apiChannel is the JSON representation of a TV channel.
+type apiChannel struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Genre      string     `json:"genre"`
+	GenreID    string     `json:"genre_id"`
+	Logo       string     `json:"logo"`        // Logo served by this service
+	LogoSource string     `json:"logo_source"` // Logo link in Stalker portal
+	Stream     string     `json:"stream"`
+	LinkType   string     `json:"link_type"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+	CMD        string     `json:"cmd"`
+}
+
+// apiGenre is the JSON representation of a genre.
+type apiGenre struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Channels int    `json:"channels"`
+}
+
+// apiPage wraps paginated results.
+type apiPage struct {
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Items   interface{} `json:"items"`
+}
+
+func linkTypeName(linkType int) string {
+	switch linkType {
+	case linkTypeHLS:
+		return "hls"
+	case linkTypeMedia:
+		return "media"
+	default:
+		return "unknown"
+	}
+}
+
+func newAPIChannel(r *http.Request, title string, c *Channel) apiChannel {
+	c.Mux.Lock()
+	linkType := c.LinkType
+	lastAccess := c.lastAccess
+	c.Mux.Unlock()
+
+	ch := apiChannel{
+		ID:         c.StalkerChannel.ID,
+		Title:      title,
+		Genre:      c.Genre,
+		GenreID:    c.StalkerChannel.GenreID,
+		Logo:       "http://" + r.Host + "/logo/" + url.PathEscape(title),
+		LogoSource: c.Logo.Link,
+		Stream:     "http://" + r.Host + "/iptv/" + url.PathEscape(title),
+		LinkType:   linkTypeName(linkType),
+		CMD:        c.StalkerChannel.CMD,
+	}
+	if !lastAccess.IsZero() {
+		ch.LastAccess = &lastAccess
+	}
+	return ch
+}
+
+// Handles '/api/v1/channels' requests
+func apiChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &channelFilter{
+		groups: splitQueryList(query["genre"], true),
+		search: strings.ToLower(strings.TrimSpace(query.Get("search"))),
+	}
+
+	list := currentChannels()
+	titles := filter.apply(list)
+	items := make([]apiChannel, 0, len(titles))
+	for _, title := range titles {
+		items = append(items, newAPIChannel(r, title, list.byTitle[title]))
+	}
+
+	page, perPage, err := apiPagination(query)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to := (page-1)*perPage, page*perPage
+	if from > len(items) {
+		from = len(items)
+	}
+	if to > len(items) {
+		to = len(items)
+	}
+
+	writeJSON(w, r, apiPage{
+		Total:   len(items),
+		Page:    page,
+		PerPage: perPage,
+		Items:   items[from:to],
+	})
+}
+
+// Handles '/api/v1/channels/' requests
+func apiChannelHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/channels/"))
+	if err != nil || id == "" {
+		apiError(w, "invalid channel id", http.StatusBadRequest)
+		return
+	}
+
+	list := currentChannels()
+	for _, title := range list.sorted {
+		c := list.byTitle[title]
+		if c.StalkerChannel.ID == id {
+			writeJSON(w, r, newAPIChannel(r, title, c))
+			return
+		}
+	}
+	apiError(w, "channel not found", http.StatusNotFound)
+}
+
+// Handles '/api/v1/genres' requests
+func apiGenresHandler(w http.ResponseWriter, r *http.Request) {
+	genres := make(map[string]*apiGenre)
+	for _, c := range currentChannels().byTitle {
+		g, ok := genres[c.Genre]
+		if !ok {
+			g = &apiGenre{ID: c.StalkerChannel.GenreID, Title: c.Genre}
+			genres[c.Genre] = g
+		}
+		g.Channels++
+	}
+
+	items := make([]apiGenre, 0, len(genres))
+	for _, g := range genres {
+		items = append(items, *g)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Title < items[j].Title })
+
+	writeJSON(w, r, items)
+}
+
+func apiPagination(query url.Values) (page, perPage int, err error) {
+	page, perPage = 1, apiDefaultPerPage
+	if v := query.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, errInvalidParam("page")
+		}
+	}
+	if v := query.Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > apiMaxPerPage {
+			return 0, 0, errInvalidParam("per_page")
+		}
+	}
+	return page, perPage, nil
+}
+
+type errInvalidParam string
+
+func (e errInvalidParam) Error() string {
+	return "invalid '" + string(e) + "' parameter"
+}
+
+// writeJSON encodes v and sends it with an ETag, answering conditional requests with 304.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		apiError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, m := range strings.Split(match, ",") {
+			m = strings.TrimPrefix(strings.TrimSpace(m), "W/")
+			if m == etag || m == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func apiError(w http.ResponseWriter, msg string, code int) {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
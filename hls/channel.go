@@ -1,6 +1,7 @@
 package hls
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -40,6 +41,31 @@ type Channel struct {
 	Genre string // TV channel genre. This field does not require synchronization
 }
 
+// retrieve returns a copy of the logo, downloading it from Stalker middleware if no cache is present.
+func (l *Logo) retrieve(portal *stalker.Portal) (Logo, error) {
+	l.Mux.Lock()
+	defer l.Mux.Unlock()
+
+	if len(l.Cache) == 0 {
+		img, contentType, err := download(context.Background(), l.Link, portal)
+		if err != nil {
+			return Logo{}, err
+		}
+		l.Cache = img
+		l.CacheContentType = contentType
+	}
+
+	// Return local copy so caller doesn't need thread synchronization
+	return *l, nil
+}
+
+// cached returns a copy of the logo if it has been downloaded already.
+func (l *Logo) cached() (Logo, bool) {
+	l.Mux.Lock()
+	defer l.Mux.Unlock()
+	return *l, len(l.Cache) != 0
+}
+
 func (c *Channel) validate() error {
 	if !c.isValid() {
 		newLink, err := c.StalkerChannel.NewLink(false)
@@ -36,7 +36,7 @@ func handleContent(cr *ContentRequest) {
 
 func handleContentUnknown(cr *ContentRequest) {
 	portal := cr.ChannelRef.StalkerChannel.Portal
-	resp, err := response(cr.ChannelRef.Link, portal)
+	resp, err := response(cr.Request.Context(), cr.ChannelRef.Link, portal)
 	if err != nil {
 		cr.ChannelRef.Mux.Unlock()
 		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
@@ -67,7 +67,7 @@ func handleContentHLS(cr *ContentRequest) {
 	}
 
 	portal := cr.Channel.StalkerChannel.Portal
-	resp, err := response(link, portal)
+	resp, err := response(cr.Request.Context(), link, portal)
 	if err != nil {
 		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
 		log.Println(err)
@@ -79,7 +79,7 @@ func handleContentHLS(cr *ContentRequest) {
 }
 
 func handleEstablishedContentHLS(cr *ContentRequest, resp *http.Response, link string) {
-	prefix := "http://" + cr.Request.Host + "/iptv/" + url.PathEscape(cr.Title) + "/"
+	prefix := "http://" + cr.Request.Host + cr.Prefix + url.PathEscape(cr.Title) + "/"
 
 	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
 	switch {
@@ -97,7 +97,7 @@ func handleEstablishedContentHLS(cr *ContentRequest, resp *http.Response, link s
 
 func handleContentMedia(cr *ContentRequest) {
 	portal := cr.Channel.StalkerChannel.Portal
-	resp, err := response(cr.Channel.Link, portal)
+	resp, err := responseRange(cr.Request.Context(), cr.Channel.Link, portal, cr.Request.Header.Get("Range"))
 	if err != nil {
 		http.Error(cr.ResponseWriter, "internal server error", http.StatusInternalServerError)
 		log.Println(err)
@@ -12,6 +12,7 @@ type ContentRequest struct {
 	ResponseWriter http.ResponseWriter
 	Request        *http.Request
 
+	Prefix     string // Path prefix of the handler, e.g. '/iptv/'
 	Title      string
 	Suffix     string
 	ChannelRef *Channel
@@ -21,6 +22,14 @@ type ContentRequest struct {
 
 // Returns ContentRequest objected that contains HTTP request, its responseWriter and TV channel reference.
 func getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix string) (*ContentRequest, error) {
+	return getContentRequestFunc(w, r, expectedPrefix, func(title string) (*Channel, bool) {
+		c, ok := currentChannels().byTitle[title]
+		return c, ok
+	})
+}
+
+// Same as getContentRequest, but channel reference is found using given lookup function.
+func getContentRequestFunc(w http.ResponseWriter, r *http.Request, expectedPrefix string, lookup func(string) (*Channel, bool)) (*ContentRequest, error) {
 	reqPath := strings.Replace(r.URL.RequestURI(), expectedPrefix, "", 1)
 	reqPathParts := strings.SplitN(reqPath, "/", 2)
 	if len(reqPathParts) == 0 {
@@ -35,7 +44,7 @@ func getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix st
 	}
 
 	// Find channel reference
-	channelRef, ok := playlist[reqPathParts[0]]
+	channelRef, ok := lookup(reqPathParts[0])
 	if !ok {
 		return nil, errors.New("bad request")
 	}
@@ -45,6 +54,7 @@ func getContentRequest(w http.ResponseWriter, r *http.Request, expectedPrefix st
 		return &ContentRequest{
 			ResponseWriter: w,
 			Request:        r,
+			Prefix:         expectedPrefix,
 			Title:          reqPathParts[0],
 			Suffix:         "",
 			ChannelRef:     channelRef,
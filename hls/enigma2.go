@@ -0,0 +1,264 @@
+package hls
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const enigma2BouquetPrefix = "userbouquet.stalkerhek_"
+
+// enigma2Bouquet stores channels of a single genre.
+type enigma2Bouquet struct {
+	Name     string   // Genre title
+	File     string   // userbouquet.*.tv filename
+	Channels []string // Sorted channel titles
+}
+
+var reEnigma2Slug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// enigma2Bouquets groups playlist channels by genre.
+func enigma2Bouquets() []*enigma2Bouquet {
+	byGenre := make(map[string]*enigma2Bouquet)
+	bouquets := make([]*enigma2Bouquet, 0)
+	list := currentChannels()
+	for _, title := range list.sorted {
+		genre := list.byTitle[title].Genre
+		b, ok := byGenre[genre]
+		if !ok {
+			b = &enigma2Bouquet{Name: genre}
+			byGenre[genre] = b
+			bouquets = append(bouquets, b)
+		}
+		b.Channels = append(b.Channels, title)
+	}
+	sort.Slice(bouquets, func(i, j int) bool { return bouquets[i].Name < bouquets[j].Name })
+
+	// Different genres may end up with the same slug, e.g. 'News & Info' and 'News/Info'
+	used := make(map[string]bool, len(bouquets))
+	for _, b := range bouquets {
+		slug := enigma2Slug(b.Name)
+		for used[slug] {
+			slug += "_" + strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(b.Name))), 16)
+		}
+		used[slug] = true
+		b.File = enigma2BouquetPrefix + slug + ".tv"
+	}
+	return bouquets
+}
+
+// enigma2Slug returns file name friendly form of genre title.
+func enigma2Slug(genre string) string {
+	slug := strings.Trim(reEnigma2Slug.ReplaceAllString(strings.ToLower(genre), "_"), "_")
+	if slug == "" {
+		slug = strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(genre))), 16)
+	}
+	return slug
+}
+
+// enigma2ServiceIDs returns unique service IDs of all channels in the list, by channel title. Stalker channel ID is
+// used when it's numeric. Other channels get ID derived from the title, moved to the next free one on collision.
+func enigma2ServiceIDs(list *channelList) map[string]uint64 {
+	ids := make(map[string]uint64, len(list.sorted))
+	used := make(map[uint64]bool, len(list.sorted))
+	var rest []string
+	for _, title := range list.sorted {
+		id, err := strconv.ParseUint(list.byTitle[title].StalkerChannel.ID, 10, 32)
+		if err != nil || id == 0 || used[id] {
+			rest = append(rest, title)
+			continue
+		}
+		ids[title] = id
+		used[id] = true
+	}
+	for _, title := range rest {
+		id := uint64(crc32.ChecksumIEEE([]byte(title)) & 0xFFFF)
+		for id == 0 || used[id] {
+			id++
+		}
+		ids[title] = id
+		used[id] = true
+	}
+	return ids
+}
+
+// enigma2ServiceRef returns service reference without the stream URL and name, e.g. '4097:0:1:1A:0:0:0:0:0:0'.
+func enigma2ServiceRef(id uint64) string {
+	return "4097:0:1:" + strings.ToUpper(strconv.FormatUint(id, 16)) + ":0:0:0:0:0:0"
+}
+
+// enigma2Escape escapes characters that have special meaning in Enigma2 service lines.
+func enigma2Escape(s string) string {
+	return strings.ReplaceAll(s, ":", "%3a")
+}
+
+// Handles '/enigma2/' requests
+func enigma2Handler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/enigma2/")
+
+	switch {
+	case name == "bouquets.tv":
+		enigma2IndexHandler(w, r)
+	case name == "picons.tar.gz":
+		enigma2PiconsHandler(w, r)
+	case strings.HasPrefix(name, enigma2BouquetPrefix):
+		for _, b := range enigma2Bouquets() {
+			if b.File == name {
+				enigma2BouquetHandler(w, r, b)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func enigma2IndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintln(w, "#NAME Stalkerhek")
+	for _, b := range enigma2Bouquets() {
+		fmt.Fprintf(w, "#SERVICE 1:7:1:0:0:0:0:0:0:0:FROM BOUQUET \"%s\" ORDER BY bouquet\n", b.File)
+	}
+}
+
+func enigma2BouquetHandler(w http.ResponseWriter, r *http.Request, b *enigma2Bouquet) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+b.File+"\"")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintln(w, "#NAME "+b.Name)
+	list := currentChannels()
+	ids := enigma2ServiceIDs(list)
+	for _, title := range b.Channels {
+		_, found := list.byTitle[title]
+		if !found {
+			// Channel list was updated since bouquets were listed
+			continue
+		}
+		link := "http://" + r.Host + "/iptv/" + url.PathEscape(title)
+		ref := enigma2ServiceRef(ids[title])
+		fmt.Fprintf(w, "#SERVICE %s:%s:%s\n", ref, enigma2Escape(link), enigma2Escape(title))
+		fmt.Fprintf(w, "#DESCRIPTION %s\n", title)
+	}
+}
+
+// Logos that are not cached yet are downloaded by piconWorkers at once before the archive is written. The ones that
+// take longer than piconPrefetchTime are left out, but keep downloading, so they are included next time.
+const (
+	piconWorkers      = 8
+	piconPrefetchTime = 15 * time.Second
+)
+
+// Picons are named by service reference, e.g. '4097_0_1_1A_0_0_0_0_0_0.png'. Enigma2 loads PNG picons only, so other
+// logos are converted, and ones that can't be decoded are skipped.
+func enigma2PiconsHandler(w http.ResponseWriter, r *http.Request) {
+	list := currentChannels()
+	enigma2PrefetchLogos(list)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"picons.tar.gz\"")
+	w.WriteHeader(http.StatusOK)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	ids := enigma2ServiceIDs(list)
+	for _, title := range list.sorted {
+		c := list.byTitle[title]
+		logo, found := c.Logo.cached()
+		if !found {
+			continue
+		}
+
+		picon, err := enigma2Picon(logo.Cache, logo.CacheContentType)
+		if err != nil {
+			log.Println("Skipping picon of '" + title + "': " + err.Error())
+			continue
+		}
+		hdr := &tar.Header{
+			Name:    "picon/" + strings.ReplaceAll(enigma2ServiceRef(ids[title]), ":", "_") + ".png",
+			Mode:    0644,
+			Size:    int64(len(picon)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := tw.Write(picon); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	tw.Close()
+	gw.Close()
+}
+
+// enigma2PrefetchLogos downloads logos that are not cached yet, waiting for them up to piconPrefetchTime.
+func enigma2PrefetchLogos(list *channelList) {
+	jobs := make(chan *Channel)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < piconWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				if _, err := c.Logo.retrieve(c.StalkerChannel.Portal); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, title := range list.sorted {
+			c := list.byTitle[title]
+			if _, found := c.Logo.cached(); !found && c.Logo.Link != "" {
+				jobs <- c
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(piconPrefetchTime):
+		log.Println("Not all channel logos were downloaded in time, the rest is left out of picons")
+	}
+}
+
+// enigma2Picon returns logo as PNG image, converting it if needed.
+func enigma2Picon(logo []byte, contentType string) ([]byte, error) {
+	if contentType == "image/png" {
+		return logo, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(logo))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func testChannels(genres map[string]string, chs map[string]string) map[string]*stalker.Channel {
+	channels := make(map[string]*stalker.Channel, len(chs))
+	for title, genreID := range chs {
+		channels[title] = &stalker.Channel{Title: title, CMD: "ffrt http://localhost/" + title, GenreID: genreID, Genres: &genres}
+	}
+	return channels
+}
+
+func TestEnigma2BouquetsUniqueFiles(t *testing.T) {
+	UpdateChannels(testChannels(
+		map[string]string{"1": "News & Info", "2": "News/Info", "3": "Sport", "4": "Новости"},
+		map[string]string{"A": "1", "B": "2", "C": "3", "D": "4"},
+	))
+
+	bouquets := enigma2Bouquets()
+	if len(bouquets) != 4 {
+		t.Fatalf("got %d bouquets, want 4", len(bouquets))
+	}
+	files := make(map[string]string)
+	for _, b := range bouquets {
+		if other, found := files[b.File]; found {
+			t.Errorf("genres %q and %q share bouquet file %q", other, b.Name, b.File)
+		}
+		files[b.File] = b.Name
+		if len(b.Channels) != 1 {
+			t.Errorf("bouquet %q has %d channels, want 1", b.Name, len(b.Channels))
+		}
+	}
+	if files[enigma2BouquetPrefix+"news_info.tv"] != "News & Info" {
+		t.Errorf("first genre in order should keep plain slug, got %v", files)
+	}
+	if files[enigma2BouquetPrefix+"sport.tv"] != "Sport" {
+		t.Errorf("missing plain slug of 'Sport', got %v", files)
+	}
+
+	// Same channels must give the same files
+	again := enigma2Bouquets()
+	for i := range bouquets {
+		if bouquets[i].File != again[i].File {
+			t.Errorf("bouquet file of %q changed from %q to %q", bouquets[i].Name, bouquets[i].File, again[i].File)
+		}
+	}
+}
+
+func TestEnigma2ServiceIDsUnique(t *testing.T) {
+	genres := map[string]string{"1": "News"}
+	chs := testChannels(genres, map[string]string{"A": "1", "B": "1", "C": "1", "D": "1"})
+	chs["A"].ID = "26"
+	chs["B"].ID = "26" // Duplicate numeric ID
+	chs["C"].ID = "abc"
+	chs["D"].ID = ""
+	UpdateChannels(chs)
+
+	ids := enigma2ServiceIDs(currentChannels())
+	if ids["A"] != 26 {
+		t.Errorf("numeric channel ID should be used, got %d", ids["A"])
+	}
+	seen := make(map[uint64]string)
+	for title, id := range ids {
+		if id == 0 {
+			t.Errorf("channel %q got zero service ID", title)
+		}
+		if other, found := seen[id]; found {
+			t.Errorf("channels %q and %q share service ID %d", other, title, id)
+		}
+		seen[id] = title
+	}
+}
@@ -0,0 +1,83 @@
+package hls
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// channelFilter selects a subset of channels from the playlist.
+type channelFilter struct {
+	groups        map[string]bool // Genre titles or IDs to include (lowercase)
+	excludeGroups map[string]bool // Genre titles or IDs to exclude (lowercase)
+	search        string          // Case-insensitive substring of channel title
+	ids           map[string]bool // Stalker channel IDs to include
+	limit         int             // Maximum amount of channels, 0 means unlimited
+}
+
+// parseChannelFilter builds filter from URL query, e.g. '?group=Sports,News&exclude_group=Adult&search=bbc&ids=1,2,3&limit=10'.
+func parseChannelFilter(query url.Values) (*channelFilter, error) {
+	f := &channelFilter{
+		groups:        splitQueryList(query["group"], true),
+		excludeGroups: splitQueryList(query["exclude_group"], true),
+		search:        strings.ToLower(strings.TrimSpace(query.Get("search"))),
+		ids:           splitQueryList(query["ids"], false),
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, errInvalidParam("limit")
+		}
+		f.limit = limit
+	}
+	return f, nil
+}
+
+// splitQueryList merges comma separated values of all given query parameters into a set.
+func splitQueryList(values []string, lower bool) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if lower {
+				item = strings.ToLower(item)
+			}
+			if item != "" {
+				set[item] = true
+			}
+		}
+	}
+	return set
+}
+
+func (f *channelFilter) match(title string, c *Channel) bool {
+	genre := strings.ToLower(c.Genre)
+	genreID := c.StalkerChannel.GenreID
+	if len(f.groups) != 0 && !f.groups[genre] && !f.groups[genreID] {
+		return false
+	}
+	if f.excludeGroups[genre] || f.excludeGroups[genreID] {
+		return false
+	}
+	if f.search != "" && !strings.Contains(strings.ToLower(title), f.search) {
+		return false
+	}
+	if len(f.ids) != 0 && !f.ids[c.StalkerChannel.ID] {
+		return false
+	}
+	return true
+}
+
+// apply returns sorted titles of channels of the list that match the filter.
+func (f *channelFilter) apply(list *channelList) []string {
+	filtered := make([]string, 0, len(list.sorted))
+	for _, title := range list.sorted {
+		if f.limit > 0 && len(filtered) >= f.limit {
+			break
+		}
+		if f.match(title, list.byTitle[title]) {
+			filtered = append(filtered, title)
+		}
+	}
+	return filtered
+}
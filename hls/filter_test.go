@@ -0,0 +1,52 @@
+package hls
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestChannelFilter(t *testing.T) {
+	chs := testChannels(
+		map[string]string{"1": "News", "2": "Sports", "3": "Adult"},
+		map[string]string{"BBC News": "1", "CNN": "1", "BBC Sport": "2", "Eurosport": "2", "Night": "3"},
+	)
+	for i, title := range []string{"BBC News", "CNN", "BBC Sport", "Eurosport", "Night"} {
+		chs[title].ID = strconv.Itoa(i + 1)
+	}
+	UpdateChannels(chs)
+	list := currentChannels()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"BBC News", "BBC Sport", "CNN", "Eurosport", "Night"}},
+		{"group=news,SPORTS", []string{"BBC News", "BBC Sport", "CNN", "Eurosport"}},
+		{"group=1&group=3", []string{"BBC News", "CNN", "Night"}},
+		{"exclude_group=Adult", []string{"BBC News", "BBC Sport", "CNN", "Eurosport"}},
+		{"search=bbc", []string{"BBC News", "BBC Sport"}},
+		{"ids=2,4", []string{"CNN", "Eurosport"}},
+		{"group=Sports&search=euro", []string{"Eurosport"}},
+		{"limit=2", []string{"BBC News", "BBC Sport"}},
+		{"group=Weather", []string{}},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		f, err := parseChannelFilter(query)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if got := f.apply(list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"limit=-1", "limit=ten"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseChannelFilter(values); err == nil {
+			t.Errorf("%q: expected error", query)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package hls
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"sync"
 	"time"
@@ -10,36 +11,82 @@ import (
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-var playlist map[string]*Channel
-var sortedChannels []string
+var config *stalker.Config
 
-// Start starts main routine.
-func Start(chs map[string]*stalker.Channel, bind string) {
-	// Initialize playlist
-	playlist = make(map[string]*Channel)
-	sortedChannels = make([]string, 0, len(chs))
+// channelList is a snapshot of the playlist. It is replaced as a whole when channels are updated, never modified.
+type channelList struct {
+	byTitle map[string]*Channel
+	sorted  []string // Sorted titles
+}
+
+var playlist *channelList
+var playlistMux sync.RWMutex
+
+// currentChannels returns current playlist.
+func currentChannels() *channelList {
+	playlistMux.RLock()
+	defer playlistMux.RUnlock()
+	if playlist == nil {
+		return &channelList{}
+	}
+	return playlist
+}
+
+// UpdateChannels replaces playlist with given channels. Channels that did not change are kept as they are, so streams
+// that are being watched continue without requesting new links.
+func UpdateChannels(chs map[string]*stalker.Channel) {
+	playlistMux.Lock()
+	defer playlistMux.Unlock()
+
+	var old map[string]*Channel
+	if playlist != nil {
+		old = playlist.byTitle
+	}
+	list := &channelList{
+		byTitle: make(map[string]*Channel, len(chs)),
+		sorted:  make([]string, 0, len(chs)),
+	}
 	for k, v := range chs {
-		playlist[k] = &Channel{
-			StalkerChannel: v,
-			Mux:            &sync.Mutex{},
-			Logo: &Logo{
-				Mux:  &sync.Mutex{},
-				Link: v.Logo(),
-			},
-			Genre: v.Genre(),
+		if c, found := old[k]; found && c.StalkerChannel.CMD == v.CMD && c.StalkerChannel.Logo() == v.Logo() && c.Genre == v.Genre() {
+			list.byTitle[k] = c
+		} else {
+			list.byTitle[k] = &Channel{
+				StalkerChannel: v,
+				Mux:            &sync.Mutex{},
+				Logo: &Logo{
+					Mux:  &sync.Mutex{},
+					Link: v.Logo(),
+				},
+				Genre: v.Genre(),
+			}
 		}
-		sortedChannels = append(sortedChannels, k)
+		list.sorted = append(list.sorted, k)
 	}
-	sort.Strings(sortedChannels)
+	sort.Strings(list.sorted)
+	playlist = list
+}
+
+// Start starts main routine.
+func Start(c *stalker.Config, chs map[string]*stalker.Channel) {
+	config = c
+
+	// Initialize playlist
+	UpdateChannels(chs)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/iptv", playlistHandler)
 	mux.HandleFunc("/iptv/", channelHandler)
 	mux.HandleFunc("/logo/", logoHandler)
+	mux.HandleFunc("/api/v1/channels", apiChannelsHandler)
+	mux.HandleFunc("/api/v1/channels/", apiChannelHandler)
+	mux.HandleFunc("/api/v1/genres", apiGenresHandler)
+	mux.HandleFunc("/enigma2/", enigma2Handler)
+	mux.HandleFunc("/vod/", onDemandHandler("/vod/", "vod"))
+	mux.HandleFunc("/archive/", onDemandHandler("/archive/", "tv_archive"))
 
 	log.Println("HLS service should be started!")
 	server := &http.Server{
-		Addr:              bind,
+		Addr:              config.HLS.Bind,
 		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       15 * time.Second,
@@ -48,3 +95,39 @@ func Start(chs map[string]*stalker.Channel, bind string) {
 	}
 	log.Fatal(server.ListenAndServe())
 }
+
+// ChannelInfo describes a playlist channel for services that link to HLS service.
+type ChannelInfo struct {
+	Title    string
+	Genre    string
+	Path     string // Stream path, e.g. '/iptv/BBC%20One'
+	LogoPath string // Logo path, e.g. '/logo/BBC%20One'. Empty if channel has no logo
+	LinkType string // "hls", "media" or "unknown" if channel was not played yet and its cmd does not tell
+}
+
+// Channels returns sorted list of playlist channels.
+func Channels() []ChannelInfo {
+	list := currentChannels()
+	channels := make([]ChannelInfo, 0, len(list.sorted))
+	for _, title := range list.sorted {
+		c := list.byTitle[title]
+		c.Mux.Lock()
+		linkType := c.LinkType
+		c.Mux.Unlock()
+		if linkType == 0 {
+			linkType = cmdLinkType(c.StalkerChannel.CMD)
+		}
+
+		info := ChannelInfo{
+			Title:    title,
+			Genre:    c.Genre,
+			Path:     "/iptv/" + url.PathEscape(title),
+			LinkType: linkTypeName(linkType),
+		}
+		if c.Logo.Link != "" {
+			info.LogoPath = "/logo/" + url.PathEscape(title)
+		}
+		channels = append(channels, info)
+	}
+	return channels
+}
@@ -9,15 +9,22 @@ import (
 
 // Handles '/iptv' requests
 func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseChannelFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
 	fmt.Fprintln(w, "#EXTM3U")
-	for _, title := range sortedChannels {
+	list := currentChannels()
+	for _, title := range filter.apply(list) {
 		link := "http://" + r.Host + "/iptv/" + url.PathEscape(title)
 		logo := "/logo/" + url.PathEscape(title)
 
-		fmt.Fprintf(w, "#EXTINF:-1 tvg-logo=\"%s\" group-title=\"%s\", %s\n%s\n", logo, playlist[title].Genre, title, link)
+		fmt.Fprintf(w, "#EXTINF:-1 tvg-logo=\"%s\" group-title=\"%s\", %s\n%s\n", logo, list.byTitle[title].Genre, title, link)
 	}
 }
 
@@ -52,29 +59,13 @@ func logoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Lock
-	cr.ChannelRef.Logo.Mux.Lock()
-
-	// Retrieve from Stalker middleware if no cache is present
-	if len(cr.ChannelRef.Logo.Cache) == 0 {
-		portal := cr.ChannelRef.StalkerChannel.Portal
-		img, contentType, err := download(cr.ChannelRef.Logo.Link, portal)
-		if err != nil {
-			cr.ChannelRef.Logo.Mux.Unlock()
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Println(err)
-			return
-		}
-		cr.ChannelRef.Logo.Cache = img
-		cr.ChannelRef.Logo.CacheContentType = contentType
+	logo, err := cr.ChannelRef.Logo.retrieve(cr.ChannelRef.StalkerChannel.Portal)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
 
-	// Create local copy so we don't need thread syncrhonization
-	logo := *cr.ChannelRef.Logo
-
-	// Unlock
-	cr.ChannelRef.Logo.Mux.Unlock()
-
 	w.Header().Set("Content-Type", logo.CacheContentType)
 	w.Write(logo.Cache)
 }
@@ -1,21 +1,20 @@
 package hls
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-const userAgentFallback = "Mozilla/5.0 (QtEmbedded; U; Linux; C) AppleWebKit/533.3 (KHTML, like Gecko) MAG200 stbapp ver: 4 rev: 2116 Mobile Safari/533.3"
-
-func download(link string, portal *stalker.Portal) (content []byte, contentType string, err error) {
-	resp, err := response(link, portal)
+func download(ctx context.Context, link string, portal *stalker.Portal) (content []byte, contentType string, err error) {
+	resp, err := response(ctx, link, portal)
 	if err != nil {
 		return nil, "", err
 	}
@@ -24,35 +23,24 @@ func download(link string, portal *stalker.Portal) (content []byte, contentType
 	return content, resp.Header.Get("Content-Type"), err
 }
 
-// This Golang's HTTP client will not follow redirects.
-//
-// This is because by default it adds "Referrer" to the header, which causes
-// 404 HTTP error in some backends. With below code such header is not added
-// and redirects should be performed manually.
-var httpClient = &http.Client{
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	},
-	Timeout: 30 * time.Second,
+func response(ctx context.Context, link string, portal *stalker.Portal) (*http.Response, error) {
+	return responseRange(ctx, link, portal, "")
 }
 
-func response(link string, portal *stalker.Portal) (*http.Response, error) {
-	req, err := http.NewRequest("GET", link, nil)
+// Same as response, but requests only given byte range (value of 'Range' header) if it's not empty.
+//
+// Redirects are not followed by HTTP client, because it adds "Referrer" to the header, which causes 404 HTTP error in
+// some backends. They are performed manually instead.
+func responseRange(ctx context.Context, link string, portal *stalker.Portal, byteRange string) (*http.Response, error) {
+	req, err := portal.Client().NewRequest(ctx, "GET", link, nil)
 	if err != nil {
 		return nil, err
 	}
-	if portal != nil {
-		stalker.ApplyPortalHeaders(req, portal, stalker.PortalReferer(portal))
-	} else {
-		req.Header.Set("User-Agent", userAgentFallback)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
 	}
 
-	var resp *http.Response
-	if portal != nil {
-		resp, err = stalker.DoWithCFRetry(httpClient, req, stalker.CFRetryMaxAttempts)
-	} else {
-		resp, err = httpClient.Do(req)
-	}
+	resp, err := portal.Client().DoNoRedirect(req)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +61,7 @@ func response(link string, portal *stalker.Portal) (*http.Response, error) {
 			return nil, errors.New("unknown error occurred")
 		}
 		newLink := linkURL.ResolveReference(redirectURL)
-		return response(newLink.String(), portal)
+		return responseRange(ctx, newLink.String(), portal, byteRange)
 	}
 
 	return nil, errors.New(link + " returned HTTP code " + strconv.Itoa(resp.StatusCode))
@@ -92,6 +80,10 @@ func addHeaders(from, to http.Header, contentLength bool) {
 			to.Set("Cache-Control", strings.Join(v, "; "))
 		case "Date":
 			to.Set("Date", strings.Join(v, "; "))
+		case "Accept-Ranges":
+			to.Set("Accept-Ranges", strings.Join(v, "; "))
+		case "Content-Range":
+			to.Set("Content-Range", strings.Join(v, "; "))
 		case "Content-Length":
 			// This is only useful for unaltered media files. It should not be copied for HLS requests because
 			// players will not attempt to receive more bytes from HTTP server than are set here, therefore some HLS
@@ -115,3 +107,24 @@ func getLinkType(contentType string) int {
 		return linkTypeMedia
 	}
 }
+
+// cmdLinkType guesses link type from channel's cmd (e.g. 'ffrt http://host/stream.m3u8') before the channel is
+// played. It returns 0 if cmd does not tell.
+func cmdLinkType(cmd string) int {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return 0
+	}
+	link, err := url.Parse(fields[len(fields)-1])
+	if err != nil {
+		return 0
+	}
+	switch strings.ToLower(path.Ext(link.Path)) {
+	case ".m3u8", ".m3u":
+		return linkTypeHLS
+	case ".ts", ".mpg", ".mpeg", ".mp4", ".mkv":
+		return linkTypeMedia
+	default:
+		return 0
+	}
+}
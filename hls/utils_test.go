@@ -0,0 +1,18 @@
+package hls
+
+import "testing"
+
+func TestCmdLinkType(t *testing.T) {
+	tests := map[string]int{
+		"ffrt http://host/live/1.m3u8":         linkTypeHLS,
+		"ffmpeg http://host/live/1.M3U8?t=abc": linkTypeHLS,
+		"http://host/live/1.ts":                linkTypeMedia,
+		"ffrt http://localhost/ch/123":         0,
+		"":                                     0,
+	}
+	for cmd, want := range tests {
+		if got := cmdLinkType(cmd); got != want {
+			t.Errorf("cmdLinkType(%q) = %d, want %d", cmd, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package hls
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// onDemandChannels holds VOD and TV archive streams that were recently requested. Unlike TV channels, they are
+// created on demand. Keys are media type and token.
+var (
+	onDemandChannels    = make(map[string]*Channel)
+	onDemandLastLookup  = make(map[string]time.Time)
+	onDemandChannelsMux sync.Mutex
+)
+
+// onDemandIdleTimeout is the time after which unused VOD or TV archive stream is forgotten.
+const onDemandIdleTimeout = time.Hour
+
+// StreamToken encodes Stalker cmd and episode number (0 if not a series) into a URL-safe token, used in
+// '/vod/<token>' and '/archive/<token>' links.
+func StreamToken(cmd string, episode int) string {
+	token := base64.RawURLEncoding.EncodeToString([]byte(cmd))
+	if episode > 0 {
+		token += "~" + strconv.Itoa(episode)
+	}
+	return token
+}
+
+func parseStreamToken(token string) (cmd string, episode int, err error) {
+	parts := strings.SplitN(token, "~", 2)
+	if len(parts) == 2 {
+		if episode, err = strconv.Atoi(parts[1]); err != nil || episode < 1 {
+			return "", 0, errors.New("invalid episode in stream token")
+		}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(b) == 0 {
+		return "", 0, errors.New("invalid stream token")
+	}
+	return string(b), episode, nil
+}
+
+// lookupOnDemandChannel returns stream of given Stalker media type ("vod" or "tv_archive") for the token, creating
+// it if needed.
+func lookupOnDemandChannel(mediaType, token string) (*Channel, bool) {
+	cmd, episode, err := parseStreamToken(token)
+	if err != nil {
+		return nil, false
+	}
+	key := mediaType + "/" + token
+
+	onDemandChannelsMux.Lock()
+	defer onDemandChannelsMux.Unlock()
+
+	// Forget streams that are no longer watched
+	now := time.Now()
+	for k, t := range onDemandLastLookup {
+		if now.Sub(t) > onDemandIdleTimeout {
+			delete(onDemandChannels, k)
+			delete(onDemandLastLookup, k)
+		}
+	}
+	onDemandLastLookup[key] = now
+
+	if c, ok := onDemandChannels[key]; ok {
+		return c, true
+	}
+
+	c := &Channel{
+		StalkerChannel: &stalker.Channel{
+			CMD:    cmd,
+			Portal: config.Portal,
+			Type:   mediaType,
+			Series: episode,
+		},
+		Mux:  &sync.Mutex{},
+		Logo: &Logo{Mux: &sync.Mutex{}},
+	}
+	onDemandChannels[key] = c
+	return c, true
+}
+
+// onDemandHandler returns handler of '/vod/' or '/archive/' requests.
+func onDemandHandler(prefix, mediaType string) http.HandlerFunc {
+	lookup := func(token string) (*Channel, bool) {
+		return lookupOnDemandChannel(mediaType, token)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		cr, err := getContentRequestFunc(w, r, prefix, lookup)
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Lock channel's mux
+		cr.ChannelRef.Mux.Lock()
+
+		// Keep track on channel access time
+		if err = cr.ChannelRef.validate(); err != nil {
+			cr.ChannelRef.Mux.Unlock()
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		// Handle content
+		handleContent(cr)
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// secretCookie is the name of cookie that carries STB's shared secret.
+const secretCookie = "stalkerhek_secret"
+
+// accessControl decides which STBs may use the proxy and what they are allowed to see.
+type accessControl struct {
+	enabled bool
+	macs    map[string]bool
+	nets    []*net.IPNet
+	clients map[string]*clientRules
+}
+
+// clientRules holds restrictions of a single STB.
+type clientRules struct {
+	secret   string
+	genres   map[string]bool // Lowercase genre titles and IDs
+	channels map[string]bool // Lowercase channel titles and IDs
+}
+
+func newAccessControl(cfg stalker.ProxyAccess) (*accessControl, error) {
+	ac := &accessControl{
+		enabled: len(cfg.AllowMACs) != 0 || len(cfg.AllowCIDRs) != 0 || len(cfg.Clients) != 0,
+		macs:    make(map[string]bool),
+		clients: make(map[string]*clientRules),
+	}
+	for _, mac := range cfg.AllowMACs {
+		ac.macs[strings.ToUpper(mac)] = true
+	}
+	for _, cidr := range cfg.AllowCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid proxy access CIDR '" + cidr + "'")
+		}
+		ac.nets = append(ac.nets, ipNet)
+	}
+	for _, c := range cfg.Clients {
+		if c.MAC == "" {
+			return nil, errors.New("proxy access client without 'mac'")
+		}
+		ac.clients[strings.ToUpper(c.MAC)] = &clientRules{
+			secret:   c.Secret,
+			genres:   lowercaseSet(c.Genres),
+			channels: lowercaseSet(c.Channels),
+		}
+	}
+	return ac, nil
+}
+
+// check returns restrictions of STB that made the request (nil if there are none) and false if STB is not allowed
+// to use the proxy at all.
+func (ac *accessControl) check(r *http.Request) (*clientRules, bool) {
+	if !ac.enabled {
+		return nil, true
+	}
+	ip, mac, sn := stbIdentity(r)
+	mac, sn = strings.ToUpper(mac), strings.ToUpper(sn)
+
+	// Individually configured STB
+	rules, found := ac.clients[mac]
+	if !found && sn != "" {
+		rules, found = ac.clients[sn]
+	}
+	if found {
+		if rules.secret != "" {
+			c, err := r.Cookie(secretCookie)
+			if err != nil || c.Value != rules.secret {
+				return nil, false
+			}
+		}
+		if len(rules.genres) == 0 && len(rules.channels) == 0 {
+			return nil, true
+		}
+		return rules, true
+	}
+
+	if (mac != "" && ac.macs[mac]) || (sn != "" && ac.macs[sn]) {
+		return nil, true
+	}
+	if clientIP := net.ParseIP(ip); clientIP != nil {
+		for _, n := range ac.nets {
+			if n.Contains(clientIP) {
+				return nil, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// allowsGenre returns true if genre is allowed by its ID or title.
+func (cr *clientRules) allowsGenre(id, title string) bool {
+	return cr.genres[strings.ToLower(id)] || cr.genres[strings.ToLower(title)]
+}
+
+// allowsChannel returns true if channel is allowed by its own or its genre's rules.
+func (cr *clientRules) allowsChannel(id, title, genreID, genreTitle string) bool {
+	if len(cr.channels) != 0 && (cr.channels[strings.ToLower(id)] || cr.channels[strings.ToLower(title)]) {
+		return true
+	}
+	if len(cr.genres) != 0 && (cr.genres[strings.ToLower(genreID)] || cr.genres[strings.ToLower(genreTitle)]) {
+		return true
+	}
+	return false
+}
+
+// allowsChannel returns true if STB with given rules may watch the channel.
+func (s *Server) allowsChannel(rules *clientRules, ch *stalker.Channel) bool {
+	return rules == nil || rules.allowsChannel(ch.ID, ch.Title, ch.GenreID, s.currentChannels().genres[ch.GenreID])
+}
+
+func (s *Server) genreHasAllowedChannels(rules *clientRules, genreID string) bool {
+	for _, ch := range s.currentChannels().byCMD {
+		if ch.GenreID == genreID && s.allowsChannel(rules, ch) {
+			return true
+		}
+	}
+	return false
+}
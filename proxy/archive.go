@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// maxProgrammes limits the number of remembered programme channels. They are forgotten all at once when exceeded.
+const maxProgrammes = 100000
+
+// epgActions are actions whose responses list programmes with their channel IDs.
+var epgActions = map[string]bool{
+	"get_simple_data_table": true,
+	"get_data_table":        true,
+	"get_short_epg":         true,
+	"get_epg_info":          true,
+	"get_week":              true,
+}
+
+// reArchiveCMD finds programme ID in 'tv_archive' cmd, e.g. 'auto /media/123456.mpg'.
+var reArchiveCMD = regexp.MustCompile(`/media/(?:file_)?(\d+)\.mpg`)
+
+// programmes remembers channel IDs of programmes seen in EPG responses, so archive links of restricted STBs can be
+// checked against channels they are allowed to watch. Archive cmds refer to programmes, not channels.
+type programmes struct {
+	mux      sync.Mutex
+	channels map[string]string // Channel IDs by programme ID
+}
+
+func newProgrammes() *programmes {
+	return &programmes{channels: make(map[string]string)}
+}
+
+func (p *programmes) channel(programmeID string) (string, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	chID, found := p.channels[programmeID]
+	return chID, found
+}
+
+// remember records programmes found anywhere in the decoded EPG payload.
+func (p *programmes) remember(js interface{}) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.walk(js)
+}
+
+func (p *programmes) walk(js interface{}) {
+	switch v := js.(type) {
+	case []interface{}:
+		for _, item := range v {
+			p.walk(item)
+		}
+	case map[string]interface{}:
+		id, chID := jsonString(v["id"]), jsonString(v["ch_id"])
+		if id != "" && chID != "" {
+			if len(p.channels) >= maxProgrammes {
+				p.channels = make(map[string]string)
+			}
+			p.channels[id] = chID
+			return
+		}
+		for _, item := range v {
+			p.walk(item)
+		}
+	}
+}
+
+func isRestrictedEPG(rc *rewriteContext) bool {
+	return rc.rules != nil && (rc.tagType == "epg" || rc.tagType == "itv") && epgActions[rc.action]
+}
+
+// rewriteProgrammes remembers programmes of EPG response without changing it.
+func (s *Server) rewriteProgrammes(rc *rewriteContext, js interface{}) interface{} {
+	s.programmes.remember(js)
+	return js
+}
+
+// linkChannel returns channel of 'create_link' request. Archive requests are resolved by their 'ch_id' query value or
+// by programme ID from cmd, as seen in earlier EPG responses.
+func (s *Server) linkChannel(rc *rewriteContext, cmd string) (*stalker.Channel, bool) {
+	channels := s.currentChannels()
+	if rc.tagType != "tv_archive" {
+		channel, found := channels.byCMD[cmd]
+		return channel, found
+	}
+
+	chID := rc.query.Get("ch_id")
+	if chID == "" {
+		m := reArchiveCMD.FindStringSubmatch(cmd)
+		if m == nil {
+			return nil, false
+		}
+		var found bool
+		if chID, found = s.programmes.channel(m[1]); !found {
+			return nil, false
+		}
+	}
+	channel, found := channels.byID[chID]
+	return channel, found
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func TestLinkChannelArchive(t *testing.T) {
+	s := &Server{programmes: newProgrammes(), filtered: make(map[filteredListKey]*filteredList), cache: &responseCache{}}
+	s.UpdateChannels(map[string]*stalker.Channel{
+		"A": {ID: "10", Title: "A", CMD: "ffrt http://localhost/ch/10"},
+		"B": {ID: "20", Title: "B", CMD: "ffrt http://localhost/ch/20"},
+	})
+
+	var epg interface{}
+	json.Unmarshal([]byte(`{"data":[{"id":"555","ch_id":"20","name":"News","mark_archive":1}],"total_items":1}`), &epg)
+	s.rewriteProgrammes(&rewriteContext{}, epg)
+
+	tests := []struct {
+		query string
+		cmd   string
+		want  string
+	}{
+		{"type=tv_archive", "auto /media/555.mpg", "B"},
+		{"type=tv_archive&ch_id=10", "auto /media/555.mpg", "A"},
+		{"type=tv_archive", "auto /media/777.mpg", ""},
+		{"type=itv", "ffrt http://localhost/ch/10", "A"},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		channel, found := s.linkChannel(&rewriteContext{action: "create_link", tagType: query.Get("type"), query: query}, tt.cmd)
+		switch {
+		case tt.want == "" && found:
+			t.Errorf("%s %q: got channel %q, want none", tt.query, tt.cmd, channel.Title)
+		case tt.want != "" && (!found || channel.Title != tt.want):
+			t.Errorf("%s %q: got %v, want channel %q", tt.query, tt.cmd, channel, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// defaultCacheTTLs are used for actions that are not listed in 'proxy: cache: ttl'.
+var defaultCacheTTLs = map[string]time.Duration{
+	"get_all_channels": time.Hour,
+	"get_genres":       time.Hour,
+	"get_ordered_list": 10 * time.Minute,
+}
+
+// deviceParams are query values that identify STB. Proxy replaces them with the ones of our account anyway, so they are
+// not part of cache key.
+var deviceParams = []string{"sn", "device_id", "device_id2", "signature", "mac"}
+
+type cacheEntry struct {
+	body       []byte
+	stored     time.Time
+	ttl        time.Duration
+	refreshing bool
+}
+
+// responseCache keeps portal responses of heavy API calls, shared by all STBs.
+type responseCache struct {
+	ttls  map[string]time.Duration // Zero or missing means action is not cached
+	stale bool                     // Serve expired entries while refreshing them
+
+	mux     sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func newResponseCache(cfg stalker.ProxyCache) (*responseCache, error) {
+	c := &responseCache{
+		ttls:    make(map[string]time.Duration),
+		stale:   cfg.StaleWhileRevalidate,
+		entries: make(map[string]*cacheEntry),
+	}
+	if !cfg.Enabled {
+		return c, nil
+	}
+	for action, ttl := range defaultCacheTTLs {
+		c.ttls[action] = ttl
+	}
+	for action, seconds := range cfg.TTL {
+		if seconds < 0 {
+			return nil, errors.New("invalid proxy cache TTL of action '" + action + "'")
+		}
+		c.ttls[action] = time.Duration(seconds) * time.Second
+	}
+	return c, nil
+}
+
+// cacheKey returns cache key of the request, ignoring per-device query values.
+func cacheKey(r *http.Request) string {
+	return queryCacheKey(r.URL.Path, r.URL.Query())
+}
+
+// queryCacheKey returns cache key of the request with the given path and URL query, ignoring per-device query values.
+func queryCacheKey(path string, query url.Values) string {
+	tmp := copyQuery(query)
+	for _, param := range deviceParams {
+		tmp.Del(param)
+	}
+	return path + "?" + tmp.Encode()
+}
+
+// get returns cached response. If it is expired, but may be served while being revalidated, refresh is true for the
+// first caller, who is then responsible for refreshing it.
+func (c *responseCache) get(key string) (body []byte, refresh, found bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return nil, false, false
+	}
+	if time.Since(entry.stored) < entry.ttl {
+		return entry.body, false, true
+	}
+	if !c.stale {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	if !entry.refreshing {
+		entry.refreshing = true
+		refresh = true
+	}
+	return entry.body, refresh, true
+}
+
+// getStale returns cached response regardless of its age. Used when portal is unreachable.
+func (c *responseCache) getStale(key string) ([]byte, bool) {
+	if !c.stale {
+		return nil, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *responseCache) put(key, action string, body []byte) {
+	c.mux.Lock()
+	c.entries[key] = &cacheEntry{body: body, stored: time.Now(), ttl: c.ttls[action]}
+	c.mux.Unlock()
+}
+
+// refreshFailed allows another request to retry refreshing the entry.
+func (c *responseCache) refreshFailed(key string) {
+	c.mux.Lock()
+	if entry, found := c.entries[key]; found {
+		entry.refreshing = false
+	}
+	c.mux.Unlock()
+}
+
+// InvalidateCache drops all cached portal responses and assembled filtered channel lists and returns how many were
+// dropped.
+func (s *Server) InvalidateCache() int {
+	s.filteredMux.Lock()
+	n := len(s.filtered)
+	s.filtered = make(map[filteredListKey]*filteredList)
+	s.filteredMux.Unlock()
+
+	s.cache.mux.Lock()
+	defer s.cache.mux.Unlock()
+	n += len(s.cache.entries)
+	s.cache.entries = make(map[string]*cacheEntry)
+	return n
+}
+
+// cachedResponse returns cached response of the request, starting its revalidation in background if it is stale.
+func (s *Server) cachedResponse(key, action, link string, r *http.Request) ([]byte, bool) {
+	body, refresh, found := s.cache.get(key)
+	if refresh {
+		go s.refreshCache(key, action, link, r.Clone(context.Background()))
+	}
+	return body, found
+}
+
+func (s *Server) refreshCache(key, action, link string, r *http.Request) {
+	body, err := s.fetch(link, r)
+	if err != nil {
+		log.Println("Failed to refresh cached '" + action + "' response: " + err.Error())
+		s.cache.refreshFailed(key)
+		return
+	}
+	s.cache.put(key, action, body)
+}
+
+// fetch forwards the request to Stalker portal and returns body of successful response.
+func (s *Server) fetch(link string, r *http.Request) ([]byte, error) {
+	resp, err := s.forwardRequest(link, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("portal responded with " + resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// isCacheable returns true if responses of the request can be cached.
+func (s *Server) isCacheable(r *http.Request, action string) bool {
+	return r.Method == http.MethodGet && s.cache.ttls[action] > 0
+}
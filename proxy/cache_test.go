@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func TestQueryCacheKeyIgnoresDevice(t *testing.T) {
+	a, _ := url.ParseQuery("type=itv&action=get_ordered_list&genre=1&p=2&mac=00:1A:79:00:00:01&sn=A&signature=x")
+	b, _ := url.ParseQuery("sn=B&p=2&genre=1&action=get_ordered_list&type=itv&device_id=y&mac=00:1A:79:00:00:02")
+	if queryCacheKey("/stalker_portal/server/load.php", a) != queryCacheKey("/stalker_portal/server/load.php", b) {
+		t.Error("requests of different STBs should share cache key")
+	}
+	if a.Get("mac") == "" {
+		t.Error("query of the request must not be modified")
+	}
+
+	c, _ := url.ParseQuery("type=itv&action=get_ordered_list&genre=1&p=3")
+	if queryCacheKey("/load.php", a) == queryCacheKey("/load.php", c) {
+		t.Error("different pages should not share cache key")
+	}
+}
+
+func TestResponseCacheStale(t *testing.T) {
+	for _, stale := range []bool{false, true} {
+		c, err := newResponseCache(stalker.ProxyCache{Enabled: true, StaleWhileRevalidate: stale, TTL: map[string]int{"get_genres": 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ttls["get_genres"] != 0 || c.ttls["get_all_channels"] != time.Hour {
+			t.Fatalf("unexpected TTLs %v", c.ttls)
+		}
+
+		c.put("key", "get_all_channels", []byte("body"))
+		if body, refresh, found := c.get("key"); !found || refresh || string(body) != "body" {
+			t.Errorf("stale=%v: fresh entry got %q, %v, %v", stale, body, refresh, found)
+		}
+
+		c.entries["key"].stored = time.Now().Add(-2 * time.Hour)
+		body, refresh, found := c.get("key")
+		if !stale {
+			if found {
+				t.Error("expired entry should not be served")
+			}
+			continue
+		}
+		if !found || !refresh || string(body) != "body" {
+			t.Errorf("expired entry got %q, %v, %v, want it served and refreshed", body, refresh, found)
+		}
+		if _, refresh, _ := c.get("key"); refresh {
+			t.Error("only the first caller should refresh the entry")
+		}
+		c.refreshFailed("key")
+		if _, refresh, _ := c.get("key"); !refresh {
+			t.Error("entry should be refreshed again after a failed refresh")
+		}
+	}
+
+	if _, err := newResponseCache(stalker.ProxyCache{Enabled: true, TTL: map[string]int{"get_genres": -1}}); err == nil {
+		t.Error("negative TTL should be rejected")
+	}
+}
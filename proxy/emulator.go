@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// emulatorPageSize is the number of channels in a single 'get_ordered_list' page, the same as in Stalker portal.
+const emulatorPageSize = 14
+
+// Emulator serves a minimal Stalker portal API to STBs from M3U playlist and XMLTV guide, without a real portal.
+// Channel lists are loaded on creation and never modified, so Emulator can be used concurrently.
+type Emulator struct {
+	clientDir  string             // Directory with Stalker web client or empty
+	channels   []*emulatorChannel // Channels in the order of playlist
+	byCMD      map[string]*emulatorChannel
+	genres     []genreResponse        // Genres in the order of playlist, without "All"
+	programmes map[string][]programme // Programmes by channel ID
+}
+
+type emulatorChannel struct {
+	ID             string       `json:"id"`
+	Name           string       `json:"name"`
+	Number         string       `json:"number"`
+	Cmd            string       `json:"cmd"`
+	Logo           string       `json:"logo"`
+	GenreID        string       `json:"tv_genre_id"`
+	XMLTVID        string       `json:"xmltv_id"`
+	UseHTTPTmpLink string       `json:"use_http_tmp_link"`
+	Status         int          `json:"status"`
+	Censored       int          `json:"censored"`
+	CMDs           []channelCMD `json:"cmds"`
+
+	url string // Stream link
+}
+
+type channelCMD struct {
+	ID             string `json:"id"`
+	ChID           string `json:"ch_id"`
+	URL            string `json:"url"`
+	UseHTTPTmpLink string `json:"use_http_tmp_link"`
+}
+
+type genreResponse struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Alias    string `json:"alias"`
+	Censored int    `json:"censored"`
+}
+
+type channelListResponse struct {
+	TotalItems   int                `json:"total_items"`
+	MaxPageItems int                `json:"max_page_items"`
+	SelectedItem int                `json:"selected_item"`
+	CurPage      int                `json:"cur_page"`
+	Data         []*emulatorChannel `json:"data"`
+}
+
+type profileResponse struct {
+	ID              int      `json:"id"`
+	Name            string   `json:"name"`
+	MAC             string   `json:"mac"`
+	Status          int      `json:"status"`
+	Blocked         string   `json:"blocked"`
+	StbLang         string   `json:"stb_lang"`
+	Locale          string   `json:"locale"`
+	WatchdogTimeout int      `json:"watchdog_timeout"`
+	AllowedStbTypes []string `json:"allowed_stb_types"`
+	Storages        []string `json:"storages"`
+}
+
+type epgEntry struct {
+	ID             string `json:"id"`
+	ChID           string `json:"ch_id"`
+	Time           string `json:"time"`
+	TimeTo         string `json:"time_to"`
+	Duration       int    `json:"duration"`
+	Name           string `json:"name"`
+	Descr          string `json:"descr"`
+	TTime          string `json:"t_time"`
+	TTimeTo        string `json:"t_time_to"`
+	StartTimestamp int64  `json:"start_timestamp"`
+	StopTimestamp  int64  `json:"stop_timestamp"`
+}
+
+// NewEmulator loads channels from configured M3U playlist and their programmes from XMLTV guide.
+func NewEmulator(c *stalker.Config) (*Emulator, error) {
+	content, err := readSource(c.Emulator.M3U)
+	if err != nil {
+		return nil, err
+	}
+	entries, guide := parseM3U(content)
+	if len(entries) == 0 {
+		return nil, errors.New("no channels in emulator m3u '" + c.Emulator.M3U + "'")
+	}
+
+	e := &Emulator{
+		clientDir:  c.Emulator.ClientDir,
+		byCMD:      make(map[string]*emulatorChannel, len(entries)),
+		programmes: make(map[string][]programme),
+	}
+
+	genreIDs := make(map[string]string)
+	for i, entry := range entries {
+		group := entry.Group
+		if group == "" {
+			group = "Other"
+		}
+		genreID, found := genreIDs[group]
+		if !found {
+			genreID = strconv.Itoa(len(genreIDs) + 1)
+			genreIDs[group] = genreID
+			e.genres = append(e.genres, genreResponse{ID: genreID, Title: group, Alias: strings.ToLower(group)})
+		}
+
+		id := strconv.Itoa(i + 1)
+		cmd := "ffrt " + entry.URL
+		ch := &emulatorChannel{
+			ID:             id,
+			Name:           entry.Name,
+			Number:         id,
+			Cmd:            cmd,
+			Logo:           entry.Logo,
+			GenreID:        genreID,
+			XMLTVID:        entry.TvgID,
+			UseHTTPTmpLink: "1",
+			Status:         1,
+			CMDs:           []channelCMD{{ID: id, ChID: id, URL: cmd, UseHTTPTmpLink: "1"}},
+			url:            entry.URL,
+		}
+		e.channels = append(e.channels, ch)
+		e.byCMD[cmd] = ch
+	}
+
+	if c.Emulator.XMLTV != "" {
+		guide = c.Emulator.XMLTV
+	}
+	if guide != "" {
+		if err = e.loadGuide(guide); err != nil {
+			// Channels are still usable without guide
+			log.Println("Failed to load XMLTV guide '" + guide + "': " + err.Error())
+		}
+	}
+
+	log.Println("Portal emulator loaded", len(e.channels), "channels in", len(e.genres), "genres")
+	return e, nil
+}
+
+// loadGuide assigns XMLTV programmes to channels, matching them by 'tvg-id' or by name.
+func (e *Emulator) loadGuide(source string) error {
+	content, err := readSource(source)
+	if err != nil {
+		return err
+	}
+	programmes, names, err := parseXMLTV(content)
+	if err != nil {
+		return err
+	}
+	for _, ch := range e.channels {
+		list, found := programmes[ch.XMLTVID]
+		if !found {
+			list = programmes[names[strings.ToLower(ch.Name)]]
+		}
+		if len(list) != 0 {
+			e.programmes[ch.ID] = list
+		}
+	}
+	return nil
+}
+
+// Start starts main routine.
+func (e *Emulator) Start(bind string) {
+	log.Println("Portal emulator should be started!")
+	server := &http.Server{
+		Addr:              bind,
+		Handler:           e,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// ServeHTTP handles a single STB request. Requests without 'action' are served from Stalker web client directory.
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.RequestURI)
+
+	query := r.URL.Query()
+	action := query.Get("action")
+	if action == "" {
+		e.serveClient(w, r)
+		return
+	}
+
+	var js, dump interface{}
+	switch action {
+	case "handshake":
+		js = handshakeResponse{Token: randomHex(16), Random: randomHex(20)}
+	case "get_profile":
+		js = e.profile(r)
+	case "do_auth":
+		js, dump = true, authResult{Status: "OK", Results: true}
+	case "get_events":
+		var wd watchdogResponse
+		wd.Data.AdditionalServicesOn = "1"
+		js = wd
+	case "log":
+		js = 1
+	case "logout":
+		js = true
+	case "get_genres":
+		js = append([]genreResponse{{ID: "*", Title: "All", Alias: "all"}}, e.genres...)
+	case "get_all_channels":
+		js = channelListResponse{TotalItems: len(e.channels), MaxPageItems: len(e.channels), Data: e.channels}
+	case "get_ordered_list":
+		js = e.orderedList(query)
+	case "create_link":
+		ch, found := e.byCMD[query.Get("cmd")]
+		if !found {
+			log.Println("STB requested 'create_link', but gave invalid CMD:", query.Get("cmd"))
+			writeError(w, http.StatusNotFound, "channel not found")
+			return
+		}
+		link := createLinkResponse{ID: ch.ID, Cmd: ch.url}
+		js, dump = link, link
+	case "get_short_epg":
+		js = e.shortEPG(query.Get("ch_id"), query.Get("size"))
+	default:
+		js = []interface{}{}
+	}
+	writeResponse(w, buildResponse(js, dump))
+}
+
+// profile returns 'get_profile' response for the STB that made the request.
+func (e *Emulator) profile(r *http.Request) profileResponse {
+	_, mac, _ := stbIdentity(r)
+	return profileResponse{
+		ID:              1,
+		Name:            "Stalkerhek",
+		MAC:             mac,
+		Blocked:         "0",
+		StbLang:         "en",
+		Locale:          "en_GB.utf8",
+		WatchdogTimeout: 120,
+		AllowedStbTypes: []string{"mag200", "mag245", "mag250", "mag254", "mag256", "mag322", "mag324", "mag349", "mag351", "mag424", "mag520", "aurahd"},
+		Storages:        []string{},
+	}
+}
+
+// orderedList returns a page of channels of the requested genre, optionally searched or sorted by name.
+func (e *Emulator) orderedList(query url.Values) channelListResponse {
+	genre := query.Get("genre")
+	search := strings.ToLower(query.Get("search"))
+	channels := make([]*emulatorChannel, 0, len(e.channels))
+	for _, ch := range e.channels {
+		if genre != "" && genre != "*" && genre != ch.GenreID {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(ch.Name), search) {
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	if query.Get("sortby") == "name" {
+		sort.SliceStable(channels, func(i, j int) bool { return strings.ToLower(channels[i].Name) < strings.ToLower(channels[j].Name) })
+	}
+
+	page, _ := strconv.Atoi(query.Get("p"))
+	if page < 1 {
+		page = 1
+	}
+	from := (page - 1) * emulatorPageSize
+	if from > len(channels) {
+		from = len(channels)
+	}
+	to := from + emulatorPageSize
+	if to > len(channels) {
+		to = len(channels)
+	}
+	return channelListResponse{
+		TotalItems:   len(channels),
+		MaxPageItems: emulatorPageSize,
+		CurPage:      page,
+		Data:         channels[from:to],
+	}
+}
+
+// shortEPG returns current and upcoming programmes of the channel.
+func (e *Emulator) shortEPG(chID, sizeValue string) []epgEntry {
+	size, err := strconv.Atoi(sizeValue)
+	if err != nil || size <= 0 {
+		size = 4
+	}
+	now := time.Now()
+	entries := make([]epgEntry, 0, size)
+	for i, p := range e.programmes[chID] {
+		if !p.Stop.After(now) {
+			continue
+		}
+		entries = append(entries, epgEntry{
+			ID:             chID + "_" + strconv.Itoa(i),
+			ChID:           chID,
+			Time:           p.Start.Local().Format("2006-01-02 15:04:05"),
+			TimeTo:         p.Stop.Local().Format("2006-01-02 15:04:05"),
+			Duration:       int(p.Stop.Sub(p.Start).Seconds()),
+			Name:           p.Title,
+			Descr:          p.Desc,
+			TTime:          p.Start.Local().Format("15:04"),
+			TTimeTo:        p.Stop.Local().Format("15:04"),
+			StartTimestamp: p.Start.Unix(),
+			StopTimestamp:  p.Stop.Unix(),
+		})
+		if len(entries) == size {
+			break
+		}
+	}
+	return entries
+}
+
+// serveClient serves Stalker web client files, which STBs load from '/stalker_portal/c/' or '/c/'.
+func (e *Emulator) serveClient(w http.ResponseWriter, r *http.Request) {
+	if e.clientDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	path := r.URL.Path
+	if idx := strings.Index(path, "/c/"); idx != -1 {
+		path = path[idx+len("/c"):]
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	http.FileServer(http.Dir(e.clientDir)).ServeHTTP(w, r2)
+}
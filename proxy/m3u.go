@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// m3uChannel is a single entry of M3U playlist.
+type m3uChannel struct {
+	Name  string
+	TvgID string
+	Logo  string
+	Group string
+	URL   string
+}
+
+// programme is a single TV programme of XMLTV guide.
+type programme struct {
+	Start, Stop time.Time
+	Title, Desc string
+}
+
+var reM3UAttribute = regexp.MustCompile(`([a-zA-Z0-9-]+)="([^"]*)"`)
+
+// readSource returns contents of a local file or remote link. Gzipped contents are decompressed.
+func readSource(source string) ([]byte, error) {
+	var content []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 60 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("failed to download '" + source + "': " + resp.Status)
+		}
+		content, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		content, err = ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return io.ReadAll(gz)
+	}
+	return content, nil
+}
+
+// parseM3U returns channels of M3U playlist and link to its XMLTV guide (url-tvg or x-tvg-url), if any.
+func parseM3U(content []byte) ([]m3uChannel, string) {
+	var channels []m3uChannel
+	var guide string
+	var current *m3uChannel
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTM3U"):
+			for _, m := range reM3UAttribute.FindAllStringSubmatch(line, -1) {
+				if m[1] == "url-tvg" || m[1] == "x-tvg-url" {
+					guide = strings.Split(m[2], ",")[0]
+				}
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			current = &m3uChannel{}
+			info := line[len("#EXTINF:"):]
+			// Title follows the last comma that is not inside attribute value
+			if idx := strings.LastIndex(info, "\","); idx != -1 {
+				current.Name = strings.TrimSpace(info[idx+2:])
+			} else if idx := strings.Index(info, ","); idx != -1 {
+				current.Name = strings.TrimSpace(info[idx+1:])
+			}
+			for _, m := range reM3UAttribute.FindAllStringSubmatch(info, -1) {
+				switch m[1] {
+				case "tvg-id":
+					current.TvgID = m[2]
+				case "tvg-name":
+					if current.Name == "" {
+						current.Name = m[2]
+					}
+				case "tvg-logo":
+					current.Logo = m[2]
+				case "group-title":
+					current.Group = m[2]
+				}
+			}
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			if current != nil && current.Group == "" {
+				current.Group = strings.TrimSpace(line[len("#EXTGRP:"):])
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			if current == nil {
+				current = &m3uChannel{}
+			}
+			current.URL = line
+			if current.Name == "" {
+				current.Name = line
+			}
+			channels = append(channels, *current)
+			current = nil
+		}
+	}
+	return channels, guide
+}
+
+type xmltvGuide struct {
+	Channels []struct {
+		ID    string   `xml:"id,attr"`
+		Names []string `xml:"display-name"`
+	} `xml:"channel"`
+	Programmes []struct {
+		Start   string `xml:"start,attr"`
+		Stop    string `xml:"stop,attr"`
+		Channel string `xml:"channel,attr"`
+		Title   string `xml:"title"`
+		Desc    string `xml:"desc"`
+	} `xml:"programme"`
+}
+
+// parseXMLTV returns programmes of XMLTV guide, sorted by start time, by XMLTV channel ID. Second return value maps
+// lowercase channel display names to XMLTV channel IDs.
+func parseXMLTV(content []byte) (map[string][]programme, map[string]string, error) {
+	var guide xmltvGuide
+	if err := xml.Unmarshal(content, &guide); err != nil {
+		return nil, nil, err
+	}
+
+	names := make(map[string]string, len(guide.Channels))
+	for _, ch := range guide.Channels {
+		for _, name := range ch.Names {
+			names[strings.ToLower(strings.TrimSpace(name))] = ch.ID
+		}
+	}
+
+	programmes := make(map[string][]programme)
+	for _, p := range guide.Programmes {
+		start, err := parseXMLTVTime(p.Start)
+		if err != nil {
+			continue
+		}
+		stop, err := parseXMLTVTime(p.Stop)
+		if err != nil {
+			continue
+		}
+		programmes[p.Channel] = append(programmes[p.Channel], programme{Start: start, Stop: stop, Title: p.Title, Desc: p.Desc})
+	}
+	for _, list := range programmes {
+		sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	}
+	return programmes, names, nil
+}
+
+func parseXMLTVTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse("20060102150405 -0700", s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("20060102150405", s, time.Local)
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testPlaylist = `#EXTM3U url-tvg="http://guide/epg.xml.gz,http://mirror/epg.xml"
+#EXTINF:-1 tvg-id="bbc.uk" tvg-logo="http://logo/bbc.png" group-title="News, UK",BBC One, London
+http://stream/bbc.m3u8
+
+#EXTINF:-1 tvg-name="Sport 1",
+#EXTGRP:Sports
+#EXTVLCOPT:http-user-agent=VLC
+http://stream/sport.ts
+http://stream/bare.ts
+`
+
+func TestParseM3U(t *testing.T) {
+	channels, guide := parseM3U([]byte(testPlaylist))
+	if guide != "http://guide/epg.xml.gz" {
+		t.Errorf("got guide %q", guide)
+	}
+	want := []m3uChannel{
+		{Name: "BBC One, London", TvgID: "bbc.uk", Logo: "http://logo/bbc.png", Group: "News, UK", URL: "http://stream/bbc.m3u8"},
+		{Name: "Sport 1", Group: "Sports", URL: "http://stream/sport.ts"},
+		{Name: "http://stream/bare.ts", URL: "http://stream/bare.ts"},
+	}
+	if !reflect.DeepEqual(channels, want) {
+		t.Errorf("got channels\n%+v\nwant\n%+v", channels, want)
+	}
+}
+
+const testGuide = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="bbc.uk"><display-name>BBC One</display-name><display-name> BBC 1 </display-name></channel>
+  <programme start="20261018200000 +0100" stop="20261018210000 +0100" channel="bbc.uk"><title>Late</title></programme>
+  <programme start="20261018180000 +0100" stop="20261018200000 +0100" channel="bbc.uk"><title>Early</title><desc>News</desc></programme>
+  <programme start="bad" stop="20261018200000 +0100" channel="bbc.uk"><title>Broken</title></programme>
+</tv>`
+
+func TestParseXMLTV(t *testing.T) {
+	programmes, names, err := parseXMLTV([]byte(testGuide))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names["bbc one"] != "bbc.uk" || names["bbc 1"] != "bbc.uk" {
+		t.Errorf("got names %v", names)
+	}
+	list := programmes["bbc.uk"]
+	if len(list) != 2 {
+		t.Fatalf("got %d programmes, want 2", len(list))
+	}
+	if list[0].Title != "Early" || list[0].Desc != "News" || list[1].Title != "Late" {
+		t.Errorf("programmes are not sorted by start: %+v", list)
+	}
+	if want := time.Date(2026, 10, 18, 17, 0, 0, 0, time.UTC); !list[0].Start.Equal(want) {
+		t.Errorf("got start %v, want %v", list[0].Start, want)
+	}
+
+	if _, _, err := parseXMLTV([]byte("<tv><programme")); err == nil {
+		t.Error("broken guide should fail")
+	}
+}
+
+func TestReadSourceGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(testPlaylist))
+	gz.Close()
+
+	f, err := ioutil.TempFile("", "playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(buf.Bytes())
+	f.Close()
+
+	content, err := readSource(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testPlaylist {
+		t.Errorf("gzipped playlist is not decompressed: %q", content)
+	}
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxFilteredPages limits the number of portal pages retrieved to answer a single filtered page.
+const maxFilteredPages = 500
+
+// filtersPages returns true if channels of the requested page are filtered by access or hide rules. Favorites are
+// not paginated in practice, so they are filtered page by page.
+func (s *Server) filtersPages(rc *rewriteContext) bool {
+	return rc.tagType == "itv" && rc.action == "get_ordered_list" && rc.query.Get("fav") != "1" && (rc.rules != nil || s.hides)
+}
+
+// filteredListTTL is how long assembled filtered channel lists are kept if 'get_ordered_list' is not cached.
+const filteredListTTL = time.Minute
+
+// filteredList is the whole filtered channel list of a genre, paginated for STB on every request.
+type filteredList struct {
+	first    []byte        // Rewritten first portal page, used as a template of responses
+	channels []interface{} // Channels of all pages that passed the filters
+	perPage  int
+	stored   time.Time
+	ttl      time.Duration
+}
+
+// filteredListKey identifies assembled list by STB restrictions and request without page number.
+type filteredListKey struct {
+	rules *clientRules
+	query string
+}
+
+// serveFilteredPage answers 'get_ordered_list' whose channels are filtered. Filtering a single portal page would
+// leave it short and make 'total_items' describe pages STB never gets, so all pages of the genre are retrieved,
+// filtered and paginated again. Assembled list is kept, so paging through it does not walk the portal again.
+func (s *Server) serveFilteredPage(w http.ResponseWriter, r *http.Request, rc *rewriteContext, query url.Values) {
+	page, _ := strconv.Atoi(rc.query.Get("p"))
+	if page < 1 {
+		page = 1
+	}
+
+	listQuery := copyQuery(query)
+	listQuery.Del("p")
+	key := filteredListKey{rules: rc.rules, query: queryCacheKey(r.URL.Path, listQuery)}
+	list, found := s.cachedFilteredList(key)
+	if !found {
+		var body []byte
+		var err error
+		if list, body, err = s.assembleFilteredList(r, rc, query); err != nil {
+			log.Println("Failed to retrieve channels page: " + err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			// Not a channel list, let STB deal with it
+			writeResponse(w, body)
+			return
+		}
+		s.storeFilteredList(key, list)
+	}
+
+	resp, err := decodeResponse(list.first)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	payload := resp["js"].(map[string]interface{})
+	start, end := 0, len(list.channels)
+	if list.perPage > 0 {
+		start, end = (page-1)*list.perPage, page*list.perPage
+		if start > len(list.channels) {
+			start = len(list.channels)
+		}
+		if end > len(list.channels) {
+			end = len(list.channels)
+		}
+	}
+	payload["data"] = list.channels[start:end]
+	payload["total_items"] = len(list.channels)
+	if _, found := payload["cur_page"]; found {
+		payload["cur_page"] = page
+	}
+	if _, found := payload["selected_item"]; found {
+		payload["selected_item"] = 0
+	}
+
+	body, err := encodeResponse(resp)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, body)
+}
+
+// assembleFilteredList retrieves all portal pages of the request and filters their channels. If portal does not
+// respond with a channel list, its rewritten response is returned instead.
+func (s *Server) assembleFilteredList(r *http.Request, rc *rewriteContext, query url.Values) (*filteredList, []byte, error) {
+	list := &filteredList{channels: make([]interface{}, 0)}
+	for p, pages := 1, 1; p <= pages && p <= maxFilteredPages; p++ {
+		pageQuery := copyQuery(query)
+		pageQuery.Set("p", strconv.Itoa(p))
+		body, err := s.portalPage(r, pageQuery)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Number of pages is known from the first one, before it's filtered
+		if p == 1 {
+			if resp, err := decodeResponse(body); err == nil {
+				if payload, ok := resp["js"].(map[string]interface{}); ok {
+					total, _ := strconv.Atoi(jsonString(payload["total_items"]))
+					list.perPage, _ = strconv.Atoi(jsonString(payload["max_page_items"]))
+					if list.perPage > 0 {
+						pages = (total + list.perPage - 1) / list.perPage
+					}
+				}
+			}
+		}
+
+		stbQuery := copyQuery(rc.query)
+		stbQuery.Set("p", strconv.Itoa(p))
+		if body, err = s.rewriteResponse(&rewriteContext{action: rc.action, tagType: rc.tagType, query: stbQuery, rules: rc.rules}, body); err != nil {
+			return nil, nil, errors.New("failed to rewrite '" + rc.action + "' response: " + err.Error())
+		}
+		resp, err := decodeResponse(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, ok := resp["js"].(map[string]interface{})
+		if !ok {
+			return nil, body, nil
+		}
+		data, _ := payload["data"].([]interface{})
+		list.channels = append(list.channels, data...)
+
+		if p == 1 {
+			list.first = body
+		}
+	}
+	return list, nil, nil
+}
+
+func (s *Server) cachedFilteredList(key filteredListKey) (*filteredList, bool) {
+	s.filteredMux.Lock()
+	defer s.filteredMux.Unlock()
+	list, found := s.filtered[key]
+	if !found || time.Since(list.stored) >= list.ttl {
+		return nil, false
+	}
+	return list, true
+}
+
+func (s *Server) storeFilteredList(key filteredListKey, list *filteredList) {
+	list.stored = time.Now()
+	list.ttl = s.cache.ttls["get_ordered_list"]
+	if list.ttl <= 0 {
+		list.ttl = filteredListTTL
+	}
+
+	s.filteredMux.Lock()
+	defer s.filteredMux.Unlock()
+	// Drop expired lists, so lists of forgotten genres and clients do not pile up
+	for k, v := range s.filtered {
+		if time.Since(v.stored) >= v.ttl {
+			delete(s.filtered, k)
+		}
+	}
+	s.filtered[key] = list
+}
+
+// portalPage returns body of portal response to 'get_ordered_list' request with the given URL query.
+func (s *Server) portalPage(r *http.Request, query url.Values) ([]byte, error) {
+	link := s.upstream + r.URL.Path + "?" + query.Encode()
+	if !s.isCacheable(r, "get_ordered_list") {
+		return s.fetch(link, r)
+	}
+
+	key := queryCacheKey(r.URL.Path, query)
+	if body, found := s.cachedResponse(key, "get_ordered_list", link, r); found {
+		return body, nil
+	}
+	body, err := s.fetch(link, r)
+	if err != nil {
+		if stale, found := s.cache.getStale(key); found {
+			log.Println("Portal is unreachable, serving stale 'get_ordered_list' response: " + err.Error())
+			return stale, nil
+		}
+		return nil, err
+	}
+	s.cache.put(key, "get_ordered_list", body)
+	return body, nil
+}
+
+func copyQuery(query url.Values) url.Values {
+	tmp := make(url.Values, len(query))
+	for k, v := range query {
+		tmp[k] = append([]string(nil), v...)
+	}
+	return tmp
+}
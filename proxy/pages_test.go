@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilteredListInvalidated(t *testing.T) {
+	s := &Server{filtered: make(map[filteredListKey]*filteredList), cache: &responseCache{entries: make(map[string]*cacheEntry)}}
+	key := filteredListKey{rules: &clientRules{}, query: "/load.php?genre=1"}
+	s.storeFilteredList(key, &filteredList{perPage: 10})
+
+	list, found := s.cachedFilteredList(key)
+	if !found {
+		t.Fatal("stored list is not found")
+	}
+	if list.ttl != filteredListTTL {
+		t.Errorf("got TTL %v without cache, want %v", list.ttl, filteredListTTL)
+	}
+	if _, found := s.cachedFilteredList(filteredListKey{query: key.query}); found {
+		t.Error("list of other STB restrictions should not be found")
+	}
+
+	list.stored = time.Now().Add(-filteredListTTL)
+	if _, found := s.cachedFilteredList(key); found {
+		t.Error("expired list should not be found")
+	}
+
+	s.storeFilteredList(key, &filteredList{})
+	if n := s.InvalidateCache(); n != 1 {
+		t.Errorf("invalidated %d entries, want 1", n)
+	}
+	if _, found := s.cachedFilteredList(key); found {
+		t.Error("list should be dropped with the cache")
+	}
+}
@@ -1,50 +1,161 @@
 package proxy
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/CrazeeGhost/stalkerhek/hls"
 	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-var (
-	destination string
+// Server proxies STB requests to Stalker portal, replacing STB's identity with the one of our account. Configuration
+// is fixed on creation, channels are replaced as a whole and all per-request state is kept on the stack, so a single
+// Server can be used concurrently and multiple Servers can run in the same process.
+type Server struct {
+	portal      *stalker.Portal   // Account (and its session) used for all STBs
+	upstream    string            // scheme://hostname:port of Stalker portal
+	modes       map[string]string // Mode of each emulated action
+	hlsPort     string            // Port of HLS service, used when rewriting links
+	channels    *channelSet       // Replaced as a whole when channels are updated
+	channelsMux sync.RWMutex
+	access      *accessControl // STBs allowed to use the proxy
+	cache       *responseCache // Responses of heavy API calls, shared by all STBs
+	rewriters   []rewriter     // Response rewriting chain
+	hides       bool           // Whether rules hide channels or genres
+
+	filtered    map[filteredListKey]*filteredList // Assembled channel lists of filtered pages
+	filteredMux sync.Mutex
+	programmes  *programmes // Channels of programmes, used to check archive links of restricted STBs
+
+	realResponses    map[string][]byte // Cached real responses of emulated actions
+	realResponsesMux sync.Mutex
+
+	sessions *Sessions // Connected STBs
+}
 
-	config *stalker.Config
+// NewServer creates proxy server for the given configuration and channels.
+func NewServer(c *stalker.Config, chs map[string]*stalker.Channel) (*Server, error) {
+	// extract scheme://hostname:port from given URL, so we don't have to do it later
+	link, err := url.Parse(c.Portal.Endpoint())
+	if err != nil {
+		return nil, err
+	}
 
-	channels map[string]*stalker.Channel
-)
+	s := &Server{
+		portal:        c.Portal,
+		upstream:      link.Scheme + "://" + link.Host,
+		modes:         make(map[string]string, len(EmulatedActions)),
+		realResponses: make(map[string][]byte),
+		filtered:      make(map[filteredListKey]*filteredList),
+		programmes:    newProgrammes(),
+		sessions:      newSessions(),
+	}
 
-// Start starts main routine.
-func Start(c *stalker.Config, chs map[string]*stalker.Channel) {
-	config = c
+	if s.access, err = newAccessControl(c.Proxy.Access); err != nil {
+		return nil, err
+	}
+	if s.cache, err = newResponseCache(c.Proxy.Cache); err != nil {
+		return nil, err
+	}
+
+	// Everything is faked by default, except links which are only rewritten if asked to
+	for _, action := range EmulatedActions {
+		s.modes[action] = ModeFake
+	}
+	if !c.Proxy.Rewrite {
+		s.modes[ActionCreateLink] = ModePass
+	}
+	for action, mode := range c.Proxy.Actions {
+		if _, ok := s.modes[action]; !ok {
+			return nil, errors.New("unknown proxy action '" + action + "'")
+		}
+		if mode != ModeFake && mode != ModePass && mode != ModeCache {
+			return nil, errors.New("invalid mode '" + mode + "' of proxy action '" + action + "'")
+		}
+		// Their responses differ with every request, so a single cached one can't be reused
+		if mode == ModeCache && (action == ActionCreateLink || action == ActionWatchdog) {
+			return nil, errors.New("mode 'cache' is not supported by proxy action '" + action + "'")
+		}
+		s.modes[action] = mode
+	}
+
+	if s.modes[ActionCreateLink] == ModeFake {
+		if !c.HLS.Enabled {
+			return nil, errors.New("HLS service must be enabled to fake proxy action 'create_link'")
+		}
+		if _, s.hlsPort, err = net.SplitHostPort(c.HLS.Bind); err != nil {
+			return nil, err
+		}
+	}
+
+	s.UpdateChannels(chs)
+
+	s.rewriters = s.newRewriters(c.Proxy.Rules)
+	s.hides = len(c.Proxy.Rules.HideChannels) != 0 || len(c.Proxy.Rules.HideGenres) != 0
+	return s, nil
+}
+
+// channelSet is a snapshot of channels known to the proxy. It is replaced as a whole, never modified.
+type channelSet struct {
+	byCMD  map[string]*stalker.Channel // Channels by CMD field
+	byID   map[string]*stalker.Channel // Channels by portal's channel ID
+	custom []*stalker.Channel          // Custom channels, in the order of configuration
+	genres map[string]string           // Genre titles by genre ID
+}
+
+// UpdateChannels replaces channels known to the proxy. Cached channel lists are dropped, so STBs get the new ones.
+func (s *Server) UpdateChannels(chs map[string]*stalker.Channel) {
+	set := &channelSet{byCMD: make(map[string]*stalker.Channel, len(chs)), byID: make(map[string]*stalker.Channel, len(chs))}
 
 	// Channels will be matched by CMD field, not by title
-	newChannels := make(map[string]*stalker.Channel)
 	for _, v := range chs {
-		newChannels[v.CMD] = v
+		set.byCMD[v.CMD] = v
+		if v.ID != "" {
+			set.byID[v.ID] = v
+		}
+		if set.genres == nil && v.Genres != nil {
+			set.genres = *v.Genres
+		}
+		if v.IsCustom() {
+			set.custom = append(set.custom, v)
+		}
 	}
-	channels = newChannels
-
-	// extract scheme://hostname:port from given URL, so we don't have to do it later
-	link, err := url.Parse(config.Portal.Location)
-	if err != nil {
-		log.Fatalln(err)
+	sort.Slice(set.custom, func(i, j int) bool {
+		a, _ := strconv.Atoi(set.custom[i].ID)
+		b, _ := strconv.Atoi(set.custom[j].ID)
+		return a < b
+	})
+
+	s.channelsMux.Lock()
+	initial := s.channels == nil
+	s.channels = set
+	s.channelsMux.Unlock()
+	if !initial {
+		s.InvalidateCache()
 	}
-	destination = link.Scheme + "://" + link.Host
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", requestHandler)
+// currentChannels returns channels known to the proxy.
+func (s *Server) currentChannels() *channelSet {
+	s.channelsMux.RLock()
+	defer s.channelsMux.RUnlock()
+	return s.channels
+}
 
+// Start starts main routine.
+func (s *Server) Start(bind string) {
 	log.Println("Proxy service should be started!")
 	server := &http.Server{
-		Addr:              config.Proxy.Bind,
-		Handler:           mux,
+		Addr:              bind,
+		Handler:           s,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       15 * time.Second,
 		WriteTimeout:      30 * time.Second,
@@ -53,7 +164,13 @@ func Start(c *stalker.Config, chs map[string]*stalker.Channel) {
 	log.Fatal(server.ListenAndServe())
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request) {
+// Sessions returns registry of STBs connected to this server.
+func (s *Server) Sessions() *Sessions {
+	return s.sessions
+}
+
+// ServeHTTP handles a single STB request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.RequestURI)
 
 	query := r.URL.Query()
@@ -73,73 +190,64 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		tagCMD = tmp[0]
 	}
 
-	// ################################################
-	// Ignore/fake some requests
-
-	// Handshake
-	if tagAction == "handshake" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"js":{"token":"` + config.Portal.Token + `","random":"b8c4ef93de04e675350605eb0086bffe51507b88e6a1662e71fe9372"},"text":"generated in: 0.01s; query counter: 1; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`))
-		return
+	// Keep track of connected STBs
+	var channelTitle string
+	if tagAction == "create_link" {
+		channelTitle = tagType + ": " + tagCMD
+		if channel, found := s.currentChannels().byCMD[tagCMD]; found {
+			channelTitle = channel.Title
+		}
 	}
-
-	// Watchdog
-	if tagAction == "get_events" && tagType == "watchdog" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"js":{"data":{"msgs":0,"additional_services_on":"1"}},"text":"generated in: 0.01s; query counter: 4; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`))
+	if !s.sessions.track(r, tagAction, channelTitle) {
+		writeError(w, http.StatusForbidden, "access denied")
 		return
 	}
-
-	// Log
-	if tagAction == "get_events" && tagType == "log" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"js":1,"text":"generated in: 0.001s; query counter: 7; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`))
+	rules, allowed := s.access.check(r)
+	if !allowed {
+		log.Println("STB is not allowed to use the proxy:", r.RemoteAddr)
+		writeError(w, http.StatusForbidden, "access denied")
 		return
 	}
-
-	// Authentication
-	if tagAction == "do_auth" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"js":true,"text":"array(2) {\n  [\"status\"]=>\n  string(2) \"OK\"\n  [\"results\"]=>\n  bool(true)\n}\ngenerated in: 1.033s; query counter: 7; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`))
-		return
+	rc := &rewriteContext{action: tagAction, tagType: tagType, query: query, rules: rules}
+	// Restricted STBs may only open channels they are allowed to see, live or from archive
+	if tagAction == "create_link" && rules != nil && (tagType == "itv" || tagType == "tv_archive") {
+		if channel, found := s.linkChannel(rc, tagCMD); !found || !s.allowsChannel(rules, channel) {
+			writeError(w, http.StatusForbidden, "access denied")
+			return
+		}
 	}
 
-	// Logout
-	if tagAction == "logout" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"js":true,"text":"generated in: 0.011s; query counter: 4; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`))
-		return
-	}
+	// ################################################
+	// Fake or answer from cache some requests
 
-	// Rewrite links
-	if config.Proxy.Rewrite && tagAction == "create_link" {
-		if tagCMD == "" {
-			log.Println("STB requested 'create_link', but did not give 'cmd' key in URL query...")
-			http.Error(w, "bad request", http.StatusBadRequest)
+	action := emulatedAction(tagAction, tagType)
+	mode := ModePass
+	if action != "" {
+		mode = s.modes[action]
+	}
+	// Custom channels are not known to Stalker portal
+	if action == ActionCreateLink && mode != ModeFake {
+		if channel, found := s.currentChannels().byCMD[tagCMD]; found && channel.IsCustom() {
+			writeResponse(w, newChannelLinkResponse(channel.Link, channel.CMD_ID, channel.CMD_CH_ID))
 			return
 		}
+	}
 
-		// Find Stalker channel
-		channel, found := channels[tagCMD]
-		if !found {
-			log.Println("STB requested 'create_link', but gave invalid CMD:", tagCMD)
-			http.Error(w, "bad request", http.StatusBadRequest)
+	switch {
+	case mode == ModeFake && action == ActionCreateLink:
+		s.rewriteLink(w, r, tagType, tagCMD)
+		return
+	case mode == ModeFake:
+		writeResponse(w, s.fakeResponse(action))
+		return
+	case mode == ModeCache:
+		s.realResponsesMux.Lock()
+		body, found := s.realResponses[action]
+		s.realResponsesMux.Unlock()
+		if found {
+			writeResponse(w, body)
 			return
 		}
-
-		// We must give full path to IPTV stream.
-		requestHost, _, _ := net.SplitHostPort(r.Host)
-		_, portHLS, _ := net.SplitHostPort(config.HLS.Bind)
-		destination = "http://" + requestHost + ":" + portHLS + "/iptv/" + url.PathEscape(channel.Title)
-
-		w.WriteHeader(http.StatusOK)
-
-		responseText := generateNewChannelLink(destination, channel.CMD_ID, channel.CMD_CH_ID)
-		w.Write([]byte(responseText))
-
-		fmt.Println(responseText)
-
-		return
 	}
 
 	// ################################################
@@ -147,44 +255,145 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Serial number
 	if _, exists := query["sn"]; exists {
-		query["sn"] = []string{config.Portal.SerialNumber}
+		query["sn"] = []string{s.portal.SerialNumber}
 	}
 
 	// Device ID
 	if _, exists := query["device_id"]; exists {
-		query["device_id"] = []string{config.Portal.DeviceID}
+		query["device_id"] = []string{s.portal.DeviceID}
 	}
 
 	// Device ID2
 	if _, exists := query["device_id2"]; exists {
-		query["device_id2"] = []string{config.Portal.DeviceID2}
+		query["device_id2"] = []string{s.portal.DeviceID2}
 	}
 
 	// Signature
 	if _, exists := query["signature"]; exists {
-		query["signature"] = []string{config.Portal.Signature}
+		query["signature"] = []string{s.portal.Signature}
 	}
 
 	// ################################################
 	// Proxy modified request to real Stalker portal and return the response
 
 	// Build (modified) URL
-	finalLink := destination + r.URL.Path
+	finalLink := s.upstream + r.URL.Path
 
 	if len(r.URL.RawQuery) != 0 {
 		finalLink += "?" + query.Encode()
 	}
 
+	// Filtered channel pages are put together from the whole filtered list
+	if s.filtersPages(rc) {
+		s.serveFilteredPage(w, r, rc, query)
+		return
+	}
+
+	// Answer heavy API calls from cache
+	cacheable := s.isCacheable(r, tagAction)
+	var key string
+	if cacheable {
+		key = cacheKey(r)
+		if body, found := s.cachedResponse(key, tagAction, finalLink, r); found {
+			s.sendBody(w, rc, body)
+			return
+		}
+	}
+
 	// Perform request
-	resp, err := getRequest(finalLink, r)
+	resp, err := s.forwardRequest(finalLink, r)
 	if err != nil {
+		if body, found := s.cache.getStale(key); cacheable && found {
+			log.Println("Portal is unreachable, serving stale '" + tagAction + "' response: " + err.Error())
+			s.sendBody(w, rc, body)
+			return
+		}
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
+	// Serve stale response if portal is down
+	if cacheable && resp.StatusCode >= http.StatusInternalServerError {
+		if body, found := s.cache.getStale(key); found {
+			log.Println("Portal responded with " + resp.Status + ", serving stale '" + tagAction + "' response")
+			s.sendBody(w, rc, body)
+			return
+		}
+	}
+
+	// Remember real response for later
+	if (mode == ModeCache || cacheable || s.needsRewrite(rc)) && resp.StatusCode == http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if mode == ModeCache {
+			s.realResponsesMux.Lock()
+			s.realResponses[action] = body
+			s.realResponsesMux.Unlock()
+		}
+		if cacheable {
+			s.cache.put(key, tagAction, body)
+		}
+		s.sendBody(w, rc, body)
+		return
+	}
+
 	// Send response
 	addHeaders(resp.Header, w.Header())
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
+
+// sendBody sends portal response body, passing it through the rewriting chain first if needed.
+func (s *Server) sendBody(w http.ResponseWriter, rc *rewriteContext, body []byte) {
+	if s.needsRewrite(rc) {
+		var err error
+		if body, err = s.rewriteResponse(rc, body); err != nil {
+			log.Println("Failed to rewrite '" + rc.action + "' response: " + err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeResponse(w, body)
+}
+
+// rewriteLink answers 'create_link' request with a link to HLS service.
+func (s *Server) rewriteLink(w http.ResponseWriter, r *http.Request, tagType, tagCMD string) {
+	if tagCMD == "" {
+		log.Println("STB requested 'create_link', but did not give 'cmd' key in URL query...")
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	// We must give full path to the stream.
+	requestHost, _, _ := net.SplitHostPort(r.Host)
+	hlsRoot := "http://" + requestHost + ":" + s.hlsPort
+
+	var destination string
+	var id, chID string
+	switch tagType {
+	case "vod", "tv_archive":
+		series, _ := strconv.Atoi(r.URL.Query().Get("series"))
+		prefix := "/vod/"
+		if tagType == "tv_archive" {
+			prefix = "/archive/"
+		}
+		destination = hlsRoot + prefix + hls.StreamToken(tagCMD, series)
+		id, chID = "0", "0"
+	default:
+		// Find Stalker channel
+		channel, found := s.currentChannels().byCMD[tagCMD]
+		if !found {
+			log.Println("STB requested 'create_link', but gave invalid CMD:", tagCMD)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		destination = hlsRoot + "/iptv/" + url.PathEscape(channel.Title)
+		id, chID = channel.CMD_ID, channel.CMD_CH_ID
+	}
+
+	writeResponse(w, newChannelLinkResponse(destination, id, chID))
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Modes of emulated actions.
+const (
+	ModeFake  = "fake"  // Answer with a generated response
+	ModePass  = "pass"  // Forward to Stalker portal
+	ModeCache = "cache" // Forward once, then answer with the cached real response
+)
+
+// Actions of Stalker portal API that proxy can emulate.
+const (
+	ActionHandshake  = "handshake"
+	ActionWatchdog   = "watchdog"
+	ActionLog        = "log"
+	ActionDoAuth     = "do_auth"
+	ActionLogout     = "logout"
+	ActionCreateLink = "create_link"
+)
+
+// EmulatedActions lists actions that can be configured in 'proxy: actions'.
+var EmulatedActions = []string{ActionHandshake, ActionWatchdog, ActionLog, ActionDoAuth, ActionLogout, ActionCreateLink}
+
+// emulatedAction returns name of emulated action for the given 'action' and 'type' query values or empty string.
+func emulatedAction(tagAction, tagType string) string {
+	switch {
+	case tagAction == "handshake":
+		return ActionHandshake
+	case tagAction == "get_events" && tagType == "watchdog":
+		return ActionWatchdog
+	case tagAction == "get_events" && tagType == "log":
+		return ActionLog
+	case tagAction == "do_auth":
+		return ActionDoAuth
+	case tagAction == "logout":
+		return ActionLogout
+	case tagAction == "create_link":
+		return ActionCreateLink
+	}
+	return ""
+}
+
+// portalResponse is the envelope of every Stalker portal API response.
+type portalResponse struct {
+	Js   interface{} `json:"js"`
+	Text string      `json:"text"`
+}
+
+type handshakeResponse struct {
+	Token  string `json:"token"`
+	Random string `json:"random"`
+}
+
+type watchdogResponse struct {
+	Data struct {
+		Msgs                 int    `json:"msgs"`
+		AdditionalServicesOn string `json:"additional_services_on"`
+	} `json:"data"`
+}
+
+type authResult struct {
+	Status  string `json:"status"`
+	Results bool   `json:"results"`
+}
+
+type createLinkResponse struct {
+	ID         string `json:"id"`
+	Cmd        string `json:"cmd"`
+	StreamerID int    `json:"streamer_id"`
+	LinkID     int    `json:"link_id"`
+	Load       int    `json:"load"`
+	Error      string `json:"error"`
+}
+
+// buildResponse encodes js into portal response. If dump is not nil, its PHP var_dump() representation is added to
+// the debug text, the same way Stalker portal does for some actions.
+func buildResponse(js, dump interface{}) []byte {
+	text := "generated in: 0.01s; query counter: 1; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"
+	if dump != nil {
+		text = phpDump(dump) + "\n" + text
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(portalResponse{Js: js, Text: text}); err != nil {
+		// Only possible with unsupported types, which would be a programming error
+		panic(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// writeResponse sends response body the way Stalker portal does.
+func writeResponse(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError sends portal-style error response.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	body := buildResponse(errorResponse{Error: msg}, nil)
+	w.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// fakeResponse generates response of the given emulated action.
+func (s *Server) fakeResponse(action string) []byte {
+	switch action {
+	case ActionHandshake:
+		return buildResponse(handshakeResponse{Token: s.portal.SessionToken(), Random: randomHex(20)}, nil)
+	case ActionWatchdog:
+		var wd watchdogResponse
+		wd.Data.AdditionalServicesOn = "1"
+		return buildResponse(wd, nil)
+	case ActionLog:
+		return buildResponse(1, nil)
+	case ActionDoAuth:
+		return buildResponse(true, authResult{Status: "OK", Results: true})
+	default: // ActionLogout
+		return buildResponse(true, nil)
+	}
+}
+
+// newChannelLinkResponse generates response of 'create_link' action.
+func newChannelLinkResponse(link, id, chID string) []byte {
+	linkID, _ := strconv.Atoi(chID)
+	js := createLinkResponse{ID: id, Cmd: link, LinkID: linkID}
+	return buildResponse(js, js)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// phpDump returns PHP var_dump() representation of v. Struct fields are named after their JSON tags.
+func phpDump(v interface{}) string {
+	var buf bytes.Buffer
+	phpDumpValue(&buf, reflect.ValueOf(v), "")
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func phpDumpValue(buf *bytes.Buffer, v reflect.Value, indent string) {
+	if v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			buf.WriteString(indent + "NULL\n")
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		buf.WriteString(indent + "NULL\n")
+	case reflect.String:
+		fmt.Fprintf(buf, "%sstring(%d) \"%s\"\n", indent, len(v.String()), v.String())
+	case reflect.Bool:
+		fmt.Fprintf(buf, "%sbool(%t)\n", indent, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(buf, "%sint(%d)\n", indent, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fmt.Fprintf(buf, "%sint(%d)\n", indent, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprintf(buf, "%sfloat(%s)\n", indent, strconv.FormatFloat(v.Float(), 'f', -1, 64))
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(buf, "%sarray(%d) {\n", indent, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			fmt.Fprintf(buf, "%s  [%d]=>\n", indent, i)
+			phpDumpValue(buf, v.Index(i), indent+"  ")
+		}
+		buf.WriteString(indent + "}\n")
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value, v.Len())
+		for _, k := range v.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			keys = append(keys, key)
+			values[key] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(buf, "%sarray(%d) {\n", indent, len(keys))
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%s  [\"%s\"]=>\n", indent, k)
+			phpDumpValue(buf, values[k], indent+"  ")
+		}
+		buf.WriteString(indent + "}\n")
+	case reflect.Struct:
+		t := v.Type()
+		names := make([]string, 0, t.NumField())
+		fields := make([]reflect.Value, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "-" || t.Field(i).PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = t.Field(i).Name
+			}
+			names = append(names, name)
+			fields = append(fields, v.Field(i))
+		}
+		fmt.Fprintf(buf, "%sarray(%d) {\n", indent, len(names))
+		for i, name := range names {
+			fmt.Fprintf(buf, "%s  [\"%s\"]=>\n", indent, name)
+			phpDumpValue(buf, fields[i], indent+"  ")
+		}
+		buf.WriteString(indent + "}\n")
+	default:
+		fmt.Fprintf(buf, "%sNULL\n", indent)
+	}
+}
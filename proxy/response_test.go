@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPHPDump(t *testing.T) {
+	got := phpDump(createLinkResponse{ID: "7", Cmd: "http://host/iptv/A", LinkID: 12})
+	want := `array(6) {
+  ["id"]=>
+  string(1) "7"
+  ["cmd"]=>
+  string(18) "http://host/iptv/A"
+  ["streamer_id"]=>
+  int(0)
+  ["link_id"]=>
+  int(12)
+  ["load"]=>
+  int(0)
+  ["error"]=>
+  string(0) ""
+}`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = phpDump(map[string]interface{}{"b": []int{1}, "a": true, "c": nil})
+	want = `array(3) {
+  ["a"]=>
+  bool(true)
+  ["b"]=>
+  array(1) {
+    [0]=>
+    int(1)
+  }
+  ["c"]=>
+  NULL
+}`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBuildResponse(t *testing.T) {
+	var resp struct {
+		Js   map[string]interface{} `json:"js"`
+		Text string                 `json:"text"`
+	}
+	body := buildResponse(map[string]string{"cmd": "http://host/a?b=1&c=2"}, nil)
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Js["cmd"] != "http://host/a?b=1&c=2" {
+		t.Errorf("got cmd %v", resp.Js["cmd"])
+	}
+	if body[len(body)-1] == '\n' {
+		t.Error("response should not end with a newline")
+	}
+	if string(body) != `{"js":{"cmd":"http://host/a?b=1&c=2"},"text":"`+resp.Text+`"}` {
+		t.Errorf("HTML characters should not be escaped: %s", body)
+	}
+
+	body = buildResponse(true, authResult{Status: "OK", Results: true})
+	if err := json.Unmarshal(body, &struct{ Text *string }{&resp.Text}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Text, "array(2) {") {
+		t.Errorf("debug text should start with dump, got %q", resp.Text)
+	}
+}
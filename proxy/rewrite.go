@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// rewriteContext describes STB request whose response is being rewritten.
+type rewriteContext struct {
+	action  string       // 'action' query value
+	tagType string       // 'type' query value
+	query   url.Values   // STB request's URL query
+	rules   *clientRules // Access restrictions of STB or nil
+}
+
+// rewriter is a single step of response rewriting chain.
+type rewriter struct {
+	applies func(rc *rewriteContext) bool                        // Whether response of the request must be rewritten by this step
+	rewrite func(rc *rewriteContext, js interface{}) interface{} // Modifies decoded 'js' payload and returns it
+}
+
+// newRewriters builds response rewriting chain. Order matters: custom channels are injected first, so rules apply to
+// them as well, and access rules and configured rules match original titles, so they go before renames.
+func (s *Server) newRewriters(cfg stalker.ProxyRules) []rewriter {
+	var chain []rewriter
+	if len(s.currentChannels().custom) != 0 {
+		chain = append(chain, rewriter{applies: isChannelsOrGenres, rewrite: s.rewriteInject})
+	}
+	chain = append(chain, rewriter{applies: isAccessRestricted, rewrite: s.rewriteAccess})
+	chain = append(chain, rewriter{applies: isRestrictedEPG, rewrite: s.rewriteProgrammes})
+
+	hideChannels, hideGenres := lowercaseSet(cfg.HideChannels), lowercaseSet(cfg.HideGenres)
+	if len(hideChannels) != 0 || len(hideGenres) != 0 {
+		chain = append(chain, rewriter{applies: isChannelsOrGenres, rewrite: func(rc *rewriteContext, js interface{}) interface{} {
+			return s.rewriteHide(rc, js, hideChannels, hideGenres)
+		}})
+	}
+
+	renameChannels, renameGenres := lowercaseMap(cfg.RenameChannels), lowercaseMap(cfg.RenameGenres)
+	if len(renameChannels) != 0 || len(renameGenres) != 0 {
+		chain = append(chain, rewriter{applies: isChannelsOrGenres, rewrite: func(rc *rewriteContext, js interface{}) interface{} {
+			return s.rewriteRename(rc, js, renameChannels, renameGenres)
+		}})
+	}
+
+	if len(cfg.MainInfo) != 0 {
+		chain = append(chain, rewriter{applies: isMainInfo, rewrite: func(rc *rewriteContext, js interface{}) interface{} {
+			info, ok := js.(map[string]interface{})
+			if !ok {
+				return js
+			}
+			for k, v := range cfg.MainInfo {
+				info[k] = v
+			}
+			return info
+		}})
+	}
+
+	return chain
+}
+
+func isChannelList(rc *rewriteContext) bool {
+	return rc.tagType == "itv" && (rc.action == "get_all_channels" || rc.action == "get_ordered_list")
+}
+
+func isChannelsOrGenres(rc *rewriteContext) bool {
+	return isChannelList(rc) || (rc.tagType == "itv" && rc.action == "get_genres")
+}
+
+func isMainInfo(rc *rewriteContext) bool {
+	return rc.action == "get_main_info"
+}
+
+func isAccessRestricted(rc *rewriteContext) bool {
+	return rc.rules != nil && isChannelsOrGenres(rc)
+}
+
+// needsRewrite returns true if response of the request must be decoded and rewritten.
+func (s *Server) needsRewrite(rc *rewriteContext) bool {
+	for _, rw := range s.rewriters {
+		if rw.applies(rc) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteResponse decodes portal response, passes its 'js' payload through the rewriting chain and encodes it back.
+func (s *Server) rewriteResponse(rc *rewriteContext, body []byte) ([]byte, error) {
+	resp, err := decodeResponse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	js := resp["js"]
+	for _, rw := range s.rewriters {
+		if rw.applies(rc) {
+			js = rw.rewrite(rc, js)
+		}
+	}
+	resp["js"] = js
+
+	return encodeResponse(resp)
+}
+
+// decodeResponse decodes portal response, keeping numbers as they are.
+func decodeResponse(body []byte) (map[string]interface{}, error) {
+	var resp map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func encodeResponse(resp map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(resp); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// rewriteInject adds custom channels and their genres.
+func (s *Server) rewriteInject(rc *rewriteContext, js interface{}) interface{} {
+	if rc.action == "get_genres" {
+		list, ok := js.([]interface{})
+		if !ok {
+			return js
+		}
+		present := make(map[string]bool, len(list))
+		for _, g := range list {
+			genre, _ := g.(map[string]interface{})
+			present[jsonString(genre["id"])] = true
+		}
+		channels := s.currentChannels()
+		for _, ch := range channels.custom {
+			if ch.GenreID != "" && !present[ch.GenreID] {
+				present[ch.GenreID] = true
+				list = append(list, map[string]interface{}{"id": ch.GenreID, "title": channels.genres[ch.GenreID]})
+			}
+		}
+		return list
+	}
+
+	// Paginated lists get custom channels of the requested genre on the first page
+	if rc.action == "get_ordered_list" {
+		if rc.query.Get("fav") == "1" {
+			return js
+		}
+		if page, _ := strconv.Atoi(rc.query.Get("p")); page > 1 {
+			return js
+		}
+	}
+	genre := rc.query.Get("genre")
+	if rc.action == "get_all_channels" {
+		genre = ""
+	}
+
+	payload, ok := js.(map[string]interface{})
+	if !ok {
+		return js
+	}
+	list, ok := payload["data"].([]interface{})
+	if !ok {
+		return js
+	}
+	added := 0
+	for _, ch := range s.currentChannels().custom {
+		if genre != "" && genre != "*" && genre != ch.GenreID {
+			continue
+		}
+		list = append(list, customChannelJSON(ch))
+		added++
+	}
+	payload["data"] = list
+	if total, err := strconv.Atoi(jsonString(payload["total_items"])); err == nil {
+		payload["total_items"] = total + added
+	}
+	return payload
+}
+
+// customChannelJSON returns custom channel the way Stalker portal lists channels.
+func customChannelJSON(ch *stalker.Channel) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                ch.ID,
+		"name":              ch.Title,
+		"cmd":               ch.CMD,
+		"logo":              ch.Logo(),
+		"tv_genre_id":       ch.GenreID,
+		"use_http_tmp_link": "1",
+		"cmds": []interface{}{map[string]interface{}{
+			"id":                ch.CMD_ID,
+			"ch_id":             ch.CMD_CH_ID,
+			"url":               ch.CMD,
+			"use_http_tmp_link": "1",
+		}},
+	}
+}
+
+// rewriteAccess hides channels and genres that STB is not allowed to see.
+func (s *Server) rewriteAccess(rc *rewriteContext, js interface{}) interface{} {
+	if rc.action == "get_genres" {
+		return filterGenres(js, func(id, title string) bool {
+			return id == "*" || rc.rules.allowsGenre(id, title) || s.genreHasAllowedChannels(rc.rules, id)
+		})
+	}
+	return filterChannels(js, func(channel map[string]interface{}) bool {
+		genreID := jsonString(channel["tv_genre_id"])
+		return rc.rules.allowsChannel(jsonString(channel["id"]), jsonString(channel["name"]), genreID, s.currentChannels().genres[genreID])
+	})
+}
+
+// rewriteHide hides configured channels and genres.
+func (s *Server) rewriteHide(rc *rewriteContext, js interface{}, channels, genres map[string]bool) interface{} {
+	if rc.action == "get_genres" {
+		return filterGenres(js, func(id, title string) bool {
+			return !genres[strings.ToLower(id)] && !genres[strings.ToLower(title)]
+		})
+	}
+	return filterChannels(js, func(channel map[string]interface{}) bool {
+		genreID := jsonString(channel["tv_genre_id"])
+		return !channels[strings.ToLower(jsonString(channel["id"]))] && !channels[strings.ToLower(jsonString(channel["name"]))] &&
+			!genres[strings.ToLower(genreID)] && !genres[strings.ToLower(s.currentChannels().genres[genreID])]
+	})
+}
+
+// rewriteRename renames configured channels and genres.
+func (s *Server) rewriteRename(rc *rewriteContext, js interface{}, channels, genres map[string]string) interface{} {
+	rename := func(item map[string]interface{}, names map[string]string, field string) {
+		if title, found := names[strings.ToLower(jsonString(item["id"]))]; found {
+			item[field] = title
+		} else if title, found := names[strings.ToLower(jsonString(item[field]))]; found {
+			item[field] = title
+		}
+	}
+	if rc.action == "get_genres" {
+		list, _ := js.([]interface{})
+		for _, g := range list {
+			if genre, ok := g.(map[string]interface{}); ok {
+				rename(genre, genres, "title")
+			}
+		}
+		return js
+	}
+	return filterChannels(js, func(channel map[string]interface{}) bool {
+		rename(channel, channels, "name")
+		return true
+	})
+}
+
+// filterGenres keeps genres of 'get_genres' payload for which keep returns true.
+func filterGenres(js interface{}, keep func(id, title string) bool) interface{} {
+	list, ok := js.([]interface{})
+	if !ok {
+		return js
+	}
+	filtered := make([]interface{}, 0, len(list))
+	for _, g := range list {
+		genre, _ := g.(map[string]interface{})
+		if keep(jsonString(genre["id"]), jsonString(genre["title"])) {
+			filtered = append(filtered, g)
+		}
+	}
+	return filtered
+}
+
+// filterChannels keeps channels of 'get_all_channels' or 'get_ordered_list' payload for which keep returns true.
+// 'total_items' is reduced by the number of removed channels, so pagination of STB stays consistent.
+func filterChannels(js interface{}, keep func(channel map[string]interface{}) bool) interface{} {
+	payload, ok := js.(map[string]interface{})
+	if !ok {
+		return js
+	}
+	list, ok := payload["data"].([]interface{})
+	if !ok {
+		return js
+	}
+	filtered := make([]interface{}, 0, len(list))
+	for _, c := range list {
+		if channel, ok := c.(map[string]interface{}); ok && keep(channel) {
+			filtered = append(filtered, c)
+		}
+	}
+	payload["data"] = filtered
+
+	if removed := len(list) - len(filtered); removed != 0 {
+		if total, err := strconv.Atoi(jsonString(payload["total_items"])); err == nil {
+			payload["total_items"] = total - removed
+		}
+	}
+	return payload
+}
+
+// jsonString returns string representation of JSON string or number. Ints are numbers set by earlier rewriters.
+func jsonString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case json.Number:
+		return s.String()
+	case int:
+		return strconv.Itoa(s)
+	}
+	return ""
+}
+
+func lowercaseSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, v := range list {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+func lowercaseMap(m map[string]string) map[string]string {
+	lower := make(map[string]string, len(m))
+	for k, v := range m {
+		lower[strings.ToLower(k)] = v
+	}
+	return lower
+}
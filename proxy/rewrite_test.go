@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func testServer(rules stalker.ProxyRules) *Server {
+	genres := map[string]string{"1": "News", "2": "Adult", "99": "Custom"}
+	s := &Server{programmes: newProgrammes(), filtered: make(map[filteredListKey]*filteredList), cache: &responseCache{}}
+	s.UpdateChannels(map[string]*stalker.Channel{
+		"BBC":   {ID: "10", Title: "BBC", CMD: "ffrt http://localhost/ch/10", GenreID: "1", Genres: &genres},
+		"Night": {ID: "20", Title: "Night", CMD: "ffrt http://localhost/ch/20", GenreID: "2", Genres: &genres},
+		"Cam":   {ID: "900", Title: "Cam", CMD: "ffrt http://cam/1", GenreID: "99", Genres: &genres, Link: "http://cam/1"},
+	})
+	s.rewriters = s.newRewriters(rules)
+	s.hides = len(rules.HideChannels) != 0 || len(rules.HideGenres) != 0
+	return s
+}
+
+// channelNames returns names of channels in 'get_all_channels' response.
+func channelNames(t *testing.T, body []byte) []string {
+	resp, err := decodeResponse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range resp["js"].(map[string]interface{})["data"].([]interface{}) {
+		names = append(names, jsonString(c.(map[string]interface{})["name"]))
+	}
+	return names
+}
+
+const allChannels = `{"js":{"total_items":2,"data":[` +
+	`{"id":10,"name":"BBC","tv_genre_id":"1"},` +
+	`{"id":20,"name":"Night","tv_genre_id":"2"}]}}`
+
+func TestRewriteChain(t *testing.T) {
+	s := testServer(stalker.ProxyRules{
+		HideGenres:     []string{"adult"},
+		RenameChannels: map[string]string{"bbc": "BBC One", "cam": "Garden"},
+		RenameGenres:   map[string]string{"1": "Headlines"},
+		MainInfo:       map[string]string{"end_date": "unlimited"},
+	})
+	rc := &rewriteContext{action: "get_all_channels", tagType: "itv", query: url.Values{}}
+	body, err := s.rewriteResponse(rc, []byte(allChannels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := channelNames(t, body), []string{"BBC One", "Garden"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got channels %v, want %v", got, want)
+	}
+	if !strings.Contains(string(body), `"total_items":2`) {
+		t.Errorf("total_items should count injected and hidden channels: %s", body)
+	}
+
+	rc = &rewriteContext{action: "get_genres", tagType: "itv", query: url.Values{}}
+	body, _ = s.rewriteResponse(rc, []byte(`{"js":[{"id":"*","title":"All"},{"id":"1","title":"News"},{"id":"2","title":"Adult"}]}`))
+	if want := `{"js":[{"id":"*","title":"All"},{"id":"1","title":"Headlines"},{"id":"99","title":"Custom"}]}`; string(body) != want {
+		t.Errorf("got genres %s, want %s", body, want)
+	}
+
+	rc = &rewriteContext{action: "get_main_info", tagType: "account_info", query: url.Values{}}
+	body, _ = s.rewriteResponse(rc, []byte(`{"js":{"end_date":"2027-01-01","phone":"1"}}`))
+	if want := `{"js":{"end_date":"unlimited","phone":"1"}}`; string(body) != want {
+		t.Errorf("got main info %s, want %s", body, want)
+	}
+}
+
+func TestRewriteAccess(t *testing.T) {
+	s := testServer(stalker.ProxyRules{RenameChannels: map[string]string{"night": "Late"}})
+	rules := &clientRules{channels: lowercaseSet([]string{"Night"})}
+	rc := &rewriteContext{action: "get_all_channels", tagType: "itv", query: url.Values{}, rules: rules}
+	body, err := s.rewriteResponse(rc, []byte(allChannels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Access rules match original titles, before renames
+	if got, want := channelNames(t, body), []string{"Late"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got channels %v, want %v", got, want)
+	}
+
+	if s.needsRewrite(&rewriteContext{action: "get_profile", tagType: "stb", query: url.Values{}, rules: rules}) {
+		t.Error("unrelated responses should not be rewritten")
+	}
+}
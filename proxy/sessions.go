@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session describes STB that uses the proxy.
+type Session struct {
+	Key          string    `json:"key"` // Unique session key, made of client IP and MAC (or serial number)
+	IP           string    `json:"ip"`
+	MAC          string    `json:"mac"`
+	SerialNumber string    `json:"sn"`
+	UserAgent    string    `json:"user_agent"`
+	LastAction   string    `json:"last_action"`
+	Channel      string    `json:"channel"` // Last channel requested with 'create_link'
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Requests     int       `json:"requests"`
+	Blocked      bool      `json:"blocked"`
+}
+
+// Sessions of STBs that were not seen for sessionIdleTimeout are forgotten, unless they are blocked. Kicked STB's
+// next request is rejected only if it comes within kickTimeout.
+const (
+	sessionIdleTimeout = 24 * time.Hour
+	kickTimeout        = time.Hour
+	expiryInterval     = time.Minute
+)
+
+// Sessions is a registry of STBs connected to the proxy.
+type Sessions struct {
+	mux        sync.Mutex
+	sessions   map[string]*Session
+	blocked    map[string]bool      // Session keys that are denied access
+	kicked     map[string]time.Time // Session keys whose next request is rejected, with time of the kick
+	lastExpiry time.Time
+}
+
+func newSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		blocked:  make(map[string]bool),
+		kicked:   make(map[string]time.Time),
+	}
+}
+
+// expire forgets idle sessions and old kicks. Caller must hold mux.
+func (s *Sessions) expire(now time.Time) {
+	if now.Sub(s.lastExpiry) < expiryInterval {
+		return
+	}
+	s.lastExpiry = now
+	for key, session := range s.sessions {
+		if !s.blocked[key] && now.Sub(session.LastSeen) > sessionIdleTimeout {
+			delete(s.sessions, key)
+		}
+	}
+	for key, kicked := range s.kicked {
+		if now.Sub(kicked) > kickTimeout {
+			delete(s.kicked, key)
+		}
+	}
+}
+
+// stbIdentity returns client IP, MAC and serial number presented by the STB.
+func stbIdentity(r *http.Request) (ip, mac, sn string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if c, err := r.Cookie("mac"); err == nil {
+		mac = c.Value
+	}
+	sn = r.URL.Query().Get("sn")
+	return ip, mac, sn
+}
+
+func sessionKey(ip, mac, sn string) string {
+	if mac == "" {
+		mac = sn
+	}
+	return ip + "/" + mac
+}
+
+// track records STB's request and returns false if STB must be denied access.
+func (s *Sessions) track(r *http.Request, action, channel string) bool {
+	ip, mac, sn := stbIdentity(r)
+	key := sessionKey(ip, mac, sn)
+	now := time.Now()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.expire(now)
+	if _, kicked := s.kicked[key]; kicked {
+		delete(s.kicked, key)
+		return false
+	}
+
+	session, found := s.sessions[key]
+	if !found {
+		session = &Session{Key: key, IP: ip, MAC: mac, FirstSeen: now}
+		s.sessions[key] = session
+	}
+	if sn != "" {
+		session.SerialNumber = sn
+	}
+	session.UserAgent = r.UserAgent()
+	session.LastAction = action
+	if channel != "" {
+		session.Channel = channel
+	}
+	session.LastSeen = now
+	session.Requests++
+	session.Blocked = s.blocked[key]
+
+	return !session.Blocked
+}
+
+// List returns copies of all sessions, most recently seen first.
+func (s *Sessions) List() []Session {
+	s.mux.Lock()
+	s.expire(time.Now())
+	list := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, *session)
+	}
+	s.mux.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// SetBlocked blocks or unblocks the STB. Returns false if there is no such session.
+func (s *Sessions) SetBlocked(key string, blocked bool) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	session, found := s.sessions[key]
+	if !found {
+		return false
+	}
+	session.Blocked = blocked
+	if blocked {
+		s.blocked[key] = true
+	} else {
+		delete(s.blocked, key)
+	}
+	return true
+}
+
+// Kick forgets the session and rejects STB's next request. Returns false if there is no such session.
+func (s *Sessions) Kick(key string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, found := s.sessions[key]; !found {
+		return false
+	}
+	delete(s.sessions, key)
+	s.kicked[key] = time.Now()
+	return true
+}
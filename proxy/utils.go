@@ -1,70 +1,60 @@
 package proxy
 
 import (
+	"io"
 	"net/http"
-	"net/url"
-	"strings"
-	"time"
-
-	"github.com/CrazeeGhost/stalkerhek/stalker"
 )
 
-func getRequest(link string, originalRequest *http.Request) (*http.Response, error) {
-	req, err := http.NewRequest("GET", link, nil)
+// Hop-by-hop headers are meaningful only for a single connection and must not be forwarded.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// forwardRequest performs the STB's request against given link, keeping its method, body and headers. Identity related
+// headers are the ones of our own account, set by portal client. Request body is streamed, not buffered.
+func (s *Server) forwardRequest(link string, originalRequest *http.Request) (*http.Response, error) {
+	var body io.Reader
+	hasBody := originalRequest.Body != nil && originalRequest.Body != http.NoBody && originalRequest.ContentLength != 0
+	if hasBody {
+		body = originalRequest.Body
+	}
+	req, err := s.portal.Client().NewRequest(originalRequest.Context(), originalRequest.Method, link, body)
 	if err != nil {
 		return nil, err
 	}
+	if hasBody {
+		req.ContentLength = originalRequest.ContentLength
+	}
 
 	for k, v := range originalRequest.Header {
-		switch k {
-		case "Authorization":
-			req.Header.Set("Authorization", "Bearer "+config.Portal.Token)
-		case "Cookie":
-			cookieText := "sn=" + url.QueryEscape(config.Portal.SerialNumber) + "; mac=" + url.QueryEscape(config.Portal.MAC) + "; stb_lang=en; timezone=" + url.QueryEscape(config.Portal.TimeZone) + ";"
-			if config.Portal.Cookies != "" {
-				if !strings.HasSuffix(cookieText, ";") {
-					cookieText += ";"
-				}
-				cookieText += " " + config.Portal.Cookies
-			}
-			req.Header.Set("Cookie", cookieText)
-		case "Referer":
-		case "Referrer":
+		switch {
+		case hopHeaders[k]:
+		case k == "Authorization", k == "Cookie", k == "Referer", k == "Referrer", k == "Content-Length":
+		case k == "Accept-Encoding":
+			// Let HTTP client negotiate compression itself, so response body is always decoded
+		case req.Header.Get(k) != "":
+			// Already set by portal client, so all requests look like the ones of our device
 		default:
-			req.Header.Set(k, v[0])
+			req.Header[k] = append([]string(nil), v...)
 		}
 	}
 
-	// Override/add browser-like headers
-	if config.Portal.UserAgent != "" {
-		req.Header.Set("User-Agent", config.Portal.UserAgent)
-	} else if req.Header.Get("User-Agent") == "" {
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36")
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("X-Requested-With", "XMLHttpRequest")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	return stalker.DoWithCFRetry(client, req, stalker.CFRetryMaxAttempts)
+	return s.portal.Client().Do(req)
 }
 
 func addHeaders(from, to http.Header) {
 	for k, v := range from {
-		to.Set(k, strings.Join(v, "; "))
+		if hopHeaders[k] {
+			continue
+		}
+		to[k] = append([]string(nil), v...)
 	}
 }
-
-func generateNewChannelLink(link, id, ch_id string) string {
-	return `{"js":{"id":"` + id + `","cmd":"` + specialLinkEscape(link) + `","streamer_id":0,"link_id":` + ch_id + `,"load":0,"error":""},"text":"array(6) {\n  [\"id\"]=>\n  string(4) \"` + id + `\"\n  [\"cmd\"]=>\n  string(99) \"` + specialLinkEscape(link) + `\"\n  [\"streamer_id\"]=>\n  int(0)\n  [\"link_id\"]=>\n  int(` + ch_id + `)\n  [\"load\"]=>\n  int(0)\n  [\"error\"]=>\n  string(0) \"\"\n}\ngenerated in: 0.01s; query counter: 8; cache hits: 0; cache miss: 0; php errors: 0; sql errors: 0;"}`
-}
-
-func specialLinkEscape(i string) string {
-	return strings.ReplaceAll(i, "/", "\\/")
-}
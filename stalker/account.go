@@ -0,0 +1,168 @@
+package stalker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccountInfo describes subscription of our account, as returned by 'get_main_info'.
+type AccountInfo struct {
+	MAC        string    `json:"mac"`
+	Phone      string    `json:"phone"`
+	TariffPlan string    `json:"tariff_plan"`
+	EndDate    time.Time `json:"end_date"`      // Zero if subscription does not expire or portal does not tell
+	EndDateRaw string    `json:"end_date_text"` // As given by portal
+	Status     int       `json:"status"`        // Account status from profile. 0 means active
+	Blocked    bool      `json:"blocked"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Account info is refreshed this often, and warnings are logged when subscription expires sooner than expiryWarning.
+// Failed refreshes are retried after accountInfoRetry, doubled on every failure up to accountInfoInterval.
+const (
+	accountInfoInterval = 6 * time.Hour
+	accountInfoRetry    = time.Minute
+	expiryWarning       = 7 * 24 * time.Hour
+)
+
+// Formats of 'end_date' seen in portals.
+var endDateLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02.01.2006 15:04",
+	"02.01.2006",
+	"January 2, 2006, 3:04 pm",
+	"January 2, 2006",
+}
+
+// AccountInfo returns subscription details of our account, retrieved the last time.
+func (p *Portal) AccountInfo() AccountInfo {
+	p.profileMux.Lock()
+	defer p.profileMux.Unlock()
+	return p.account
+}
+
+// ExpiresIn returns time left until subscription expires. Second return value is false if it does not expire or
+// expiry date is unknown.
+func (a AccountInfo) ExpiresIn() (time.Duration, bool) {
+	if a.EndDate.IsZero() {
+		return 0, false
+	}
+	return time.Until(a.EndDate), true
+}
+
+// ExpiresSoon returns true if subscription has expired or expires in less than a week.
+func (a AccountInfo) ExpiresSoon() bool {
+	left, expires := a.ExpiresIn()
+	return expires && left < expiryWarning
+}
+
+// monitorAccount retrieves account info whenever session gets authenticated and then periodically, warning about
+// approaching expiry.
+func (p *Portal) monitorAccount() {
+	authenticated := make(chan struct{}, 1)
+	p.OnStateChange(func(sc StateChange) {
+		if sc.To != StateAuthenticated {
+			return
+		}
+		select {
+		case authenticated <- struct{}{}:
+		default:
+		}
+	})
+
+	retry := accountInfoRetry
+	for {
+		wait := accountInfoInterval
+		if state, _, _ := p.State(); state == StateAuthenticated {
+			if err := p.updateAccountInfo(); err != nil {
+				log.Println("Failed to retrieve account info:", err)
+				wait = retry
+				if retry *= 2; retry > accountInfoInterval {
+					retry = accountInfoInterval
+				}
+			} else {
+				retry = accountInfoRetry
+				p.warnExpiry()
+			}
+		}
+
+		select {
+		case <-authenticated:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// updateAccountInfo retrieves account info. Failures are not reported to session supervisor, because many portals
+// don't implement this call.
+func (p *Portal) updateAccountInfo() error {
+	content, err := p.Client().Get(context.Background(), p.Endpoint()+"?type=account_info&action=get_main_info&JsHttpRequest=1-xml")
+	if err != nil {
+		return err
+	}
+	var tmp struct {
+		Js map[string]interface{} `json:"js"`
+	}
+	if err = json.Unmarshal(content, &tmp); err != nil || tmp.Js == nil {
+		return errors.New("unexpected account info response: " + truncate(string(content), 200))
+	}
+
+	profile := p.Profile()
+	info := AccountInfo{
+		MAC:        jsonString(tmp.Js["mac"]),
+		Phone:      jsonString(tmp.Js["phone"]),
+		TariffPlan: jsonString(tmp.Js["tariff_plan"]),
+		EndDateRaw: jsonString(tmp.Js["end_date"]),
+		Status:     profile.Status,
+		Blocked:    profile.Blocked,
+		Updated:    time.Now(),
+	}
+	info.EndDate = parseEndDate(info.EndDateRaw)
+	if info.TariffPlan == "" {
+		info.TariffPlan = profile.TariffPlan
+	}
+
+	p.profileMux.Lock()
+	p.account = info
+	p.profileMux.Unlock()
+	return nil
+}
+
+// warnExpiry logs a warning if subscription has expired or expires soon.
+func (p *Portal) warnExpiry() {
+	info := p.AccountInfo()
+	left, _ := info.ExpiresIn()
+	switch {
+	case !info.ExpiresSoon():
+	case left <= 0:
+		log.Println("WARNING: Stalker portal subscription has expired on", info.EndDate.Format("2006-01-02 15:04"))
+	default:
+		log.Println("WARNING: Stalker portal subscription expires in", strconv.Itoa(int(left.Hours()/24)), "days, on", info.EndDate.Format("2006-01-02 15:04"))
+	}
+}
+
+// parseEndDate returns subscription end date, or zero time if it's unlimited or unknown.
+func parseEndDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "0000") {
+		return time.Time{}
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if ts <= 0 {
+			return time.Time{}
+		}
+		return time.Unix(ts, 0)
+	}
+	for _, layout := range endDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
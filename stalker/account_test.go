@@ -0,0 +1,26 @@
+package stalker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEndDate(t *testing.T) {
+	tests := map[string]time.Time{
+		"2027-03-01 12:30:00":    time.Date(2027, 3, 1, 12, 30, 0, 0, time.Local),
+		"2027-03-01":             time.Date(2027, 3, 1, 0, 0, 0, 0, time.Local),
+		"01.03.2027":             time.Date(2027, 3, 1, 0, 0, 0, 0, time.Local),
+		"March 1, 2027, 2:05 pm": time.Date(2027, 3, 1, 14, 5, 0, 0, time.Local),
+		"1803902400":             time.Unix(1803902400, 0),
+		" 2027-03-01 ":           time.Date(2027, 3, 1, 0, 0, 0, 0, time.Local),
+		"0000-00-00 00:00:00":    {},
+		"0":                      {},
+		"":                       {},
+		"unlimited":              {},
+	}
+	for s, want := range tests {
+		if got := parseEndDate(s); !got.Equal(want) {
+			t.Errorf("parseEndDate(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
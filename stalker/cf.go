@@ -77,38 +77,13 @@ func DoWithCFRetry(client *http.Client, req *http.Request, maxAttempts int) (*ht
 	return client.Do(cur)
 }
 
-// ApplyPortalHeaders sets User-Agent, Cookie, and optionally Referer on req
-// using portal configuration. Used for stream/logo fetches (e.g. HLS) so
-// Cloudflare and similar protection see browser-like headers and cf_clearance
-// when configured.
-func ApplyPortalHeaders(req *http.Request, p *Portal, referer string) {
-	ua := p.UserAgent
-	if ua == "" {
-		ua = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
-	}
-	req.Header.Set("User-Agent", ua)
-	cookie := "sn=" + url.QueryEscape(p.SerialNumber) + "; mac=" + url.QueryEscape(p.MAC) + "; stb_lang=en; timezone=" + url.QueryEscape(p.TimeZone)
-	if p.Cookies != "" {
-		if !strings.HasSuffix(cookie, ";") {
-			cookie += ";"
-		}
-		cookie += " " + strings.TrimSpace(p.Cookies)
-	}
-	req.Header.Set("Cookie", cookie)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	if referer != "" {
-		req.Header.Set("Referer", referer)
-	}
-}
-
 // PortalReferer returns the scheme+host of the portal URL to use as Referer
 // for stream/logo requests (e.g. when same origin or CDN expects it).
 func PortalReferer(p *Portal) string {
-	if p == nil || p.Location == "" {
+	if p == nil || p.Endpoint() == "" {
 		return ""
 	}
-	u, err := url.Parse(p.Location)
+	u, err := url.Parse(p.Endpoint())
 	if err != nil {
 		return ""
 	}
@@ -1,15 +1,19 @@
 package stalker
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 // Channel stores information about channel in Stalker portal. This is not a real TV channel representation, but details on how to retrieve a working channel's URL.
 type Channel struct {
+	ID       string             // Channel's ID in Stalker portal
 	Title    string             // Used for Proxy service to generate fake response to new URL request
 	CMD      string             // channel's identifier in Stalker portal
 	LogoLink string             // Link to logo
@@ -19,6 +23,11 @@ type Channel struct {
 
 	CMD_ID    string // Used for Proxy service to generate fake response to new URL request
 	CMD_CH_ID string // Used for Proxy service to generate fake response to new URL request
+
+	Type   string // Media type in Stalker portal: "itv" (default), "vod" or "tv_archive"
+	Series int    // Episode number when requesting link of VOD series
+
+	Link string // Stream link of custom channel, which is used instead of asking Stalker portal
 }
 
 // NewLink retrieves a link to the working channel. Retrieved link can be played in VLC or Kodi, but expires very soon if not being constantly opened (used).
@@ -30,30 +39,33 @@ func (c *Channel) NewLink(retry bool) (string, error) {
 	}
 	var tmp tmpStruct
 
-	link := c.Portal.Location + "?action=create_link&type=itv&cmd=" + url.PathEscape(c.CMD) + "&JsHttpRequest=1-xml"
-	content, err := c.Portal.httpRequest(link)
+	if c.IsCustom() {
+		return c.Link, nil
+	}
+
+	mediaType := c.Type
+	if mediaType == "" {
+		mediaType = "itv"
+	}
+	link := c.Portal.Endpoint() + "?action=create_link&type=" + mediaType + "&cmd=" + url.PathEscape(c.CMD)
+	if c.Series > 0 {
+		link += "&series=" + strconv.Itoa(c.Series)
+	}
+	link += "&JsHttpRequest=1-xml"
+	content, err := c.Portal.Client().Get(context.Background(), link)
 	if err != nil {
+		c.Portal.reportFailure(err)
 		return "", err
 	}
 
 	if err := json.Unmarshal(content, &tmp); err != nil {
-		// It could be that session has expired and user need to authenticate again.
+		// It could be that session has expired and we need to handshake and authenticate again.
 		log.Println("Failed to retrieve new link...")
-		if !retry && c.Portal.Username != "" && c.Portal.Password != "" {
-			log.Println("Attempting to re-authenticate via username and password ...")
-			if err2 := c.Portal.authenticate(); err2 != nil {
-				log.Println("Reauthentication failed...")
-				return "", err
-			}
-			log.Println("Reauthentication success, retrying to retrieve new link...")
-			return c.NewLink(true)
-		} else if !retry && c.Portal.DeviceID != "" && c.Portal.DeviceID2 != "" {
-			log.Println("Attempting to re-authenticate via Device Ids ...")
-			if err2 := c.Portal.authenticateWithDeviceIDs(); err2 != nil {
-				log.Println("Reauthentication failed...")
-				return "", err
-			}
-			log.Println("Reauthentication success, retrying to retrieve new link...")
+		cause := errors.New("unexpected create_link response: " + truncate(string(content), 200))
+		if retry {
+			c.Portal.reportFailure(cause)
+		} else if c.Portal.reconnect(cause) == nil {
+			log.Println("Session re-established, retrying to retrieve new link...")
 			return c.NewLink(true)
 		}
 		return "", err
@@ -72,22 +84,10 @@ func (c *Channel) Logo() string {
 	if c.LogoLink == "" {
 		return ""
 	}
-	// Derive portal root. If /stalker_portal/ exists in path, keep up to it;
-	// otherwise default to /stalker_portal/ at the host root.
-	u, err := url.Parse(c.Portal.Location)
-	if err != nil || u.Host == "" {
-		// Fallback: append a safe default path
-		base := strings.TrimRight(c.Portal.Location, "/")
-		return base + "/stalker_portal/misc/logos/320/" + c.LogoLink
-	}
-	rootPath := "/stalker_portal/"
-	if idx := strings.Index(u.Path, "/stalker_portal/"); idx != -1 {
-		rootPath = u.Path[:idx+len("/stalker_portal/")]
-	}
-	u.Path = strings.TrimRight(rootPath, "/") + "/misc/logos/320/" + c.LogoLink
-	u.RawQuery = ""
-	u.Fragment = ""
-	return u.String()
+	if strings.Contains(c.LogoLink, "://") {
+		return c.LogoLink
+	}
+	return portalRoot(c.Portal.Endpoint()) + "misc/logos/320/" + c.LogoLink
 }
 
 // Genre returns a genre title
@@ -99,44 +99,57 @@ func (c *Channel) Genre() string {
 	return strings.Title(g)
 }
 
-// RetrieveChannels retrieves all TV channels from stalker portal.
+// portalChannel is a channel the way portal lists it in 'get_all_channels' and 'get_ordered_list'.
+type portalChannel struct {
+	ID      interface{} `json:"id"`          // Channel's ID, as number or string
+	Name    string      `json:"name"`        // Title of channel
+	Cmd     string      `json:"cmd"`         // Some sort of URL used to request channel real URL
+	Logo    string      `json:"logo"`        // Link to logo
+	GenreID string      `json:"tv_genre_id"` // Genre ID
+	CMDs    []struct {
+		ID    string `json:"id"`    // Used for Proxy service to generate fake response to new URL request
+		CH_ID string `json:"ch_id"` // Used for Proxy service to generate fake response to new URL request
+	} `json:"cmds"`
+}
+
+// RetrieveChannels retrieves all TV channels from stalker portal. If portal returns an empty or truncated list, the
+// channels are retrieved genre by genre, page by page.
 func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	type tmpStruct struct {
 		Js struct {
-			Data []struct {
-				Name    string `json:"name"`        // Title of channel
-				Cmd     string `json:"cmd"`         // Some sort of URL used to request channel real URL
-				Logo    string `json:"logo"`        // Link to logo
-				GenreID string `json:"tv_genre_id"` // Genre ID
-				CMDs    []struct {
-					ID    string `json:"id"`    // Used for Proxy service to generate fake response to new URL request
-					CH_ID string `json:"ch_id"` // Used for Proxy service to generate fake response to new URL request
-				} `json:"cmds"`
-			} `json:"data"`
+			TotalItems interface{}     `json:"total_items"`
+			Data       []portalChannel `json:"data"`
 		} `json:"js"`
 	}
 	var tmp tmpStruct
 
-	content, err := p.httpRequest(p.Location + "?type=itv&action=get_all_channels&JsHttpRequest=1-xml")
-	if err != nil {
+	if err := p.apiRequest(p.Endpoint()+"?type=itv&action=get_all_channels&JsHttpRequest=1-xml", &tmp); err != nil {
 		return nil, err
 	}
 
-	// Dump json output to file
-	//ioutil.WriteFile("/tmp/dumpedchannels.json", content, 0644)
-
-	if err := json.Unmarshal(content, &tmp); err != nil {
-		log.Fatalln(string(content))
-	}
-
 	genres, err := p.getGenres()
 	if err != nil {
 		return nil, err
 	}
 
+	data := tmp.Js.Data
+	if total := jsonInt(tmp.Js.TotalItems); len(data) == 0 || total > len(data) {
+		log.Println("Portal returned", len(data), "of", total, "channels, retrieving channels genre by genre...")
+		paged, err := p.retrieveChannelsByGenre(genres)
+		if err != nil && len(data) == 0 {
+			p.reportFailure(err)
+			return nil, err
+		}
+		if err != nil {
+			log.Println("Failed to retrieve channels genre by genre, using truncated list:", err)
+		}
+		data = append(data, paged...)
+	}
+
 	// Build channels list and return
-	channels := make(map[string]*Channel, len(tmp.Js.Data))
-	for _, v := range tmp.Js.Data {
+	data = uniqueChannels(data)
+	channels := make(map[string]*Channel, len(data))
+	for _, v := range data {
 		cmdID := ""
 		chID := ""
 		if len(v.CMDs) > 0 {
@@ -144,6 +157,7 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 			chID = v.CMDs[0].CH_ID
 		}
 		channels[v.Name] = &Channel{
+			ID:        jsonString(v.ID),
 			Title:     v.Name,
 			CMD:       v.Cmd,
 			LogoLink:  v.Logo,
@@ -158,6 +172,24 @@ func (p *Portal) RetrieveChannels() (map[string]*Channel, error) {
 	return channels, nil
 }
 
+// uniqueChannels drops repeated listings of the same channel, e.g. ones found both in full list and in genre pages.
+// Channels are told apart by ID and cmd, and channels without ID are all kept.
+func uniqueChannels(data []portalChannel) []portalChannel {
+	seen := make(map[string]bool, len(data))
+	unique := make([]portalChannel, 0, len(data))
+	for _, v := range data {
+		if id := jsonString(v.ID); id != "" {
+			key := id + "\x00" + v.Cmd
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		unique = append(unique, v)
+	}
+	return unique
+}
+
 func (p *Portal) getGenres() (map[string]string, error) {
 	type tmpStruct struct {
 		Js []struct {
@@ -167,15 +199,10 @@ func (p *Portal) getGenres() (map[string]string, error) {
 	}
 	var tmp tmpStruct
 
-	content, err := p.httpRequest(p.Location + "?action=get_genres&type=itv&JsHttpRequest=1-xml")
-	if err != nil {
+	if err := p.apiRequest(p.Endpoint()+"?action=get_genres&type=itv&JsHttpRequest=1-xml", &tmp); err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(content, &tmp); err != nil {
-		log.Fatalln(string(content))
-	}
-
 	genres := make(map[string]string, len(tmp.Js))
 	for _, el := range tmp.Js {
 		genres[el.ID] = el.Title
@@ -183,3 +210,64 @@ func (p *Portal) getGenres() (map[string]string, error) {
 
 	return genres, nil
 }
+
+// ChannelDiff describes changes between two channel lists. Channels are identified by title.
+type ChannelDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string // CMD (or its IDs), logo or genre has changed
+}
+
+// DiffChannels compares channels retrieved from portal. Custom channels are ignored.
+func DiffChannels(old, updated map[string]*Channel) ChannelDiff {
+	var diff ChannelDiff
+	for title, ch := range updated {
+		if ch.IsCustom() {
+			continue
+		}
+		prev, found := old[title]
+		switch {
+		case !found || prev.IsCustom():
+			diff.Added = append(diff.Added, title)
+		case prev.CMD != ch.CMD || prev.CMD_ID != ch.CMD_ID || prev.CMD_CH_ID != ch.CMD_CH_ID || prev.LogoLink != ch.LogoLink || prev.Genre() != ch.Genre():
+			diff.Changed = append(diff.Changed, title)
+		}
+	}
+	for title, ch := range old {
+		if _, found := updated[title]; !found && !ch.IsCustom() {
+			diff.Removed = append(diff.Removed, title)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// Empty returns true if nothing has changed.
+func (d ChannelDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns a short summary of changes, e.g. "2 added (A, B), 1 removed (C)".
+func (d ChannelDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	for _, p := range []struct {
+		what   string
+		titles []string
+	}{{"added", d.Added}, {"removed", d.Removed}, {"changed", d.Changed}} {
+		if len(p.titles) == 0 {
+			continue
+		}
+		titles := p.titles
+		more := ""
+		if len(titles) > 5 {
+			titles, more = titles[:5], ", ..."
+		}
+		parts = append(parts, strconv.Itoa(len(p.titles))+" "+p.what+" ("+strings.Join(titles, ", ")+more+")")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,71 @@
+package stalker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUniqueChannels(t *testing.T) {
+	var tmp struct {
+		Data []portalChannel `json:"data"`
+	}
+	err := json.Unmarshal([]byte(`{"data":[
+		{"id":10,"name":"A","cmd":"ffrt http://localhost/ch/10"},
+		{"id":"10","name":"A","cmd":"ffrt http://localhost/ch/10"},
+		{"id":"10","name":"A HD","cmd":"ffrt http://localhost/ch/10hd"},
+		{"id":"ch-abc","name":"B","cmd":"ffrt http://localhost/ch/b"},
+		{"name":"C","cmd":"ffrt http://localhost/ch/c"},
+		{"name":"D","cmd":"ffrt http://localhost/ch/d"}
+	]}`), &tmp)
+	if err != nil {
+		t.Fatal("non-numeric ID should be accepted:", err)
+	}
+
+	unique := uniqueChannels(tmp.Data)
+	var names []string
+	for _, v := range unique {
+		names = append(names, v.Name)
+	}
+	want := []string{"A", "A HD", "B", "C", "D"}
+	if len(names) != len(want) {
+		t.Fatalf("got channels %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got channels %v, want %v", names, want)
+		}
+	}
+	if id := jsonString(unique[0].ID); id != "10" {
+		t.Errorf("numeric ID converted to %q, want \"10\"", id)
+	}
+}
+
+func TestDiffChannels(t *testing.T) {
+	genres := map[string]string{"1": "News", "2": "Sports"}
+	old := map[string]*Channel{
+		"Same":   {Title: "Same", CMD: "ffrt http://localhost/ch/1", CMD_ID: "101", GenreID: "1", Genres: &genres},
+		"Moved":  {Title: "Moved", CMD: "ffrt http://localhost/ch/2", GenreID: "1", Genres: &genres},
+		"NewID":  {Title: "NewID", CMD: "ffrt http://localhost/ch/3", CMD_ID: "103", Genres: &genres},
+		"Gone":   {Title: "Gone", CMD: "ffrt http://localhost/ch/4", Genres: &genres},
+		"Custom": {Title: "Custom", CMD: "http://cam", Link: "http://cam"},
+	}
+	updated := map[string]*Channel{
+		"Same":  {Title: "Same", CMD: "ffrt http://localhost/ch/1", CMD_ID: "101", GenreID: "1", Genres: &genres},
+		"Moved": {Title: "Moved", CMD: "ffrt http://localhost/ch/2", GenreID: "2", Genres: &genres},
+		"NewID": {Title: "NewID", CMD: "ffrt http://localhost/ch/3", CMD_ID: "203", Genres: &genres},
+		"Fresh": {Title: "Fresh", CMD: "ffrt http://localhost/ch/5", Genres: &genres},
+	}
+
+	diff := DiffChannels(old, updated)
+	if !reflect.DeepEqual(diff.Added, []string{"Fresh"}) || !reflect.DeepEqual(diff.Removed, []string{"Gone"}) ||
+		!reflect.DeepEqual(diff.Changed, []string{"Moved", "NewID"}) {
+		t.Errorf("got %+v", diff)
+	}
+	if want := "1 added (Fresh), 1 removed (Gone), 2 changed (Moved, NewID)"; diff.String() != want {
+		t.Errorf("got summary %q, want %q", diff.String(), want)
+	}
+	if !DiffChannels(updated, updated).Empty() {
+		t.Error("same channels should not differ")
+	}
+}
@@ -0,0 +1,195 @@
+package stalker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUserAgent is User-Agent of browser device profiles, unless 'portal: user_agent' is set.
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+
+// apiTimeout limits duration of a single portal API call. Streams are not limited, only cancelled with their context.
+const apiTimeout = 30 * time.Second
+
+// Middleware modifies request right before it is sent.
+type Middleware func(req *http.Request)
+
+// Client performs all HTTP requests on behalf of Portal: API calls, streams and logos. Requests share connections,
+// header and cookie policy, and cookies that portal (or Cloudflare in front of it) sets, such as PHPSESSID or __cf_bm.
+type Client struct {
+	portal     *Portal
+	http       *http.Client // Follows redirects
+	noRedirect *http.Client // Returns redirects to the caller
+
+	mux         sync.Mutex
+	middlewares []Middleware
+}
+
+// sharedTransport is used by clients of all portals.
+var sharedTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   15 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   20,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+func newClient(p *Portal) *Client {
+	jar, _ := cookiejar.New(nil) // Never fails without options
+	return &Client{
+		portal: p,
+		http:   &http.Client{Transport: sharedTransport, Jar: jar},
+		noRedirect: &http.Client{
+			Transport: sharedTransport,
+			Jar:       jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Client returns HTTP client of the portal.
+func (p *Portal) Client() *Client {
+	p.clientOnce.Do(func() {
+		p.client = newClient(p)
+	})
+	return p.client
+}
+
+// Use adds middleware that is applied to every request sent by this client.
+func (c *Client) Use(m Middleware) {
+	c.mux.Lock()
+	c.middlewares = append(c.middlewares, m)
+	c.mux.Unlock()
+}
+
+// NewRequest creates request with headers and cookies of our device. Requests to the portal itself carry our token
+// and look like API calls of the device's browser, while requests to other hosts (streams, logos) only carry our
+// identity.
+func (c *Client) NewRequest(ctx context.Context, method, link string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, link, body)
+	if err != nil {
+		return nil, err
+	}
+	p := c.portal
+	d := p.device
+
+	req.Header.Set("User-Agent", d.UserAgent)
+	req.Header.Set("X-User-Agent", d.xUserAgent())
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Cookie", c.cookie())
+
+	portalURL, err := url.Parse(p.Endpoint())
+	if err != nil || portalURL.Host != req.URL.Host {
+		req.Header.Set("Referer", PortalReferer(p))
+		if d.Browser {
+			req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+		}
+		return req, nil
+	}
+
+	req.Header.Set("Authorization", "Bearer "+p.SessionToken())
+	if !d.Browser {
+		// Built-in browser of STBs sends nothing else
+		req.Header.Set("Referer", clientReferer(p.Endpoint()))
+		req.Header.Set("Accept-Language", "en-US,*")
+		return req, nil
+	}
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	req.Header.Set("Origin", portalURL.Scheme+"://"+portalURL.Host)
+	req.Header.Set("Referer", p.Endpoint())
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	req.Header.Set("Sec-Fetch-Dest", "empty")
+	req.Header.Set("Sec-Fetch-Mode", "cors")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Set("Sec-CH-UA", `"Chromium";v="131", "Not_A Brand";v="24"`)
+	req.Header.Set("Sec-CH-UA-Mobile", "?0")
+	req.Header.Set("Sec-CH-UA-Platform", `"Windows"`)
+	return req, nil
+}
+
+// cookie returns value of 'Cookie' header that identifies our account. Cookies set by portal are added by cookie jar.
+func (c *Client) cookie() string {
+	p := c.portal
+	cookie := "sn=" + url.QueryEscape(p.SerialNumber) + "; mac=" + url.QueryEscape(p.MAC) + "; stb_lang=en; timezone=" + url.QueryEscape(p.TimeZone)
+	if cookies := strings.TrimSpace(p.Cookies); cookies != "" {
+		cookie += "; " + strings.TrimSuffix(cookies, ";")
+	}
+	return cookie
+}
+
+// Do sends the request, following redirects. Requests without body are retried if Cloudflare challenges them.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	return c.do(c.http, req)
+}
+
+// DoNoRedirect is the same as Do, but returns redirect responses instead of following them.
+func (c *Client) DoNoRedirect(req *http.Request) (*http.Response, error) {
+	return c.do(c.noRedirect, req)
+}
+
+func (c *Client) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	c.mux.Lock()
+	middlewares := c.middlewares
+	c.mux.Unlock()
+	for _, m := range middlewares {
+		m(req)
+	}
+
+	// Request body can be read only once, so such requests can't be retried
+	if req.Body != nil && req.Body != http.NoBody {
+		return client.Do(req)
+	}
+	return DoWithCFRetry(client, req, CFRetryMaxAttempts)
+}
+
+// Get performs portal API call and returns response body.
+func (c *Client) Get(ctx context.Context, link string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	req, err := c.NewRequest(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.New("Site '" + link + "' returned " + resp.Status)
+	}
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// If we received an HTML body that looks like Cloudflare, provide a clear hint
+	if isHTML(contents) {
+		lower := strings.ToLower(string(contents))
+		if strings.Contains(lower, "cloudflare") || strings.Contains(lower, "cf_clearance") {
+			return nil, fmt.Errorf("%w: set portal.cookies with cf_clearance and portal.user_agent", errCloudflareChallenge)
+		}
+	}
+	return contents, nil
+}
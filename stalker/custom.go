@@ -0,0 +1,71 @@
+package stalker
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// customIDBase is added to numbers of custom channels and genres, so their IDs don't collide with the ones of Stalker
+// portal.
+const customIDBase = 900000
+
+// customCMDPrefix is the start of CMD of custom channels. STBs send it back in 'create_link' requests.
+const customCMDPrefix = "ffrt http://stalkerhek/custom/"
+
+// IsCustom returns true if channel comes from configuration instead of Stalker portal.
+func (c *Channel) IsCustom() bool {
+	return c.Link != ""
+}
+
+// AddCustomChannels adds custom channels to channels retrieved from Stalker portal. Genres that portal does not have
+// are added to the genres mapping shared by portal channels.
+func (p *Portal) AddCustomChannels(channels map[string]*Channel, custom []CustomChannel) {
+	var genres *map[string]string
+	for _, ch := range channels {
+		if ch.Genres != nil {
+			genres = ch.Genres
+			break
+		}
+	}
+	if genres == nil {
+		tmp := make(map[string]string)
+		genres = &tmp
+	}
+
+	// Genres by lowercase title
+	genreIDs := make(map[string]string, len(*genres))
+	for id, title := range *genres {
+		genreIDs[strings.ToLower(title)] = id
+	}
+
+	newGenres := 0
+	for i, cc := range custom {
+		if _, exists := channels[cc.Title]; exists {
+			log.Println("Custom channel '" + cc.Title + "' has the same title as portal channel, skipping...")
+			continue
+		}
+
+		genreID, found := genreIDs[strings.ToLower(cc.Genre)]
+		if !found && cc.Genre != "" {
+			genreID = strconv.Itoa(customIDBase + newGenres)
+			newGenres++
+			genreIDs[strings.ToLower(cc.Genre)] = genreID
+			(*genres)[genreID] = cc.Genre
+		}
+
+		id := strconv.Itoa(customIDBase + i)
+		channels[cc.Title] = &Channel{
+			ID:        id,
+			Title:     cc.Title,
+			CMD:       customCMDPrefix + id,
+			LogoLink:  cc.Logo,
+			Portal:    p,
+			GenreID:   genreID,
+			Genres:    genres,
+			CMD_ID:    id,
+			CMD_CH_ID: id,
+			Link:      cc.URL,
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package stalker
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Device describes how we present ourselves to Stalker portal: headers of every request and firmware details sent
+// in 'get_profile'.
+type Device struct {
+	Name         string // Profile name, as in 'portal: device'
+	STBType      string // Value of 'stb_type' and model in 'X-User-Agent'. Empty means 'portal: model'
+	UserAgent    string
+	Version      string // Value of 'ver' in 'get_profile'
+	HWVersion    string
+	ImageVersion string
+	Browser      bool // Requests look like XHR calls of a desktop browser instead of STB's built-in browser
+}
+
+const (
+	mag200UserAgent   = "Mozilla/5.0 (QtEmbedded; U; Linux; C) AppleWebKit/533.3 (KHTML, like Gecko) MAG200 stbapp ver: 2 rev: 250 Safari/533.3"
+	mag254UserAgent   = "Mozilla/5.0 (QtEmbedded; U; Linux; C) AppleWebKit/533.3 (KHTML, like Gecko) MAG200 stbapp ver: 4 rev: 2721 Mobile Safari/533.3"
+	magWebKitAgent    = "Mozilla/5.0 (QtEmbedded; U; Linux; C) AppleWebKit/537.36 (KHTML, like Gecko) MAG200 stbapp ver: 4 rev: 3296 Safari/537.36"
+	magPortalVersion  = "PORTAL version: 5.6.1; API Version: JS API version: 343; STB API version: 146; Player Engine version: 0x58c"
+	mag250PortalVer   = "PORTAL version: 5.6.1; API Version: JS API version: 328; STB API version: 134; Player Engine version: 0x566"
+	infomirWebVersion = "ImageDescription: web; ImageDate: Mon Jan 1 00:00:00 UTC 2024; " + magPortalVersion
+)
+
+// devices are the profiles that can be selected with 'portal: device'.
+var devices = map[string]Device{
+	"mag250": {
+		STBType:      "MAG250",
+		UserAgent:    mag200UserAgent,
+		Version:      "ImageDescription: 0.2.18-r14-pub-250; ImageDate: Fri Jan 15 15:20:44 EET 2016; " + mag250PortalVer,
+		HWVersion:    "1.7-BD-00",
+		ImageVersion: "218",
+	},
+	"mag254": {
+		STBType:      "MAG254",
+		UserAgent:    mag254UserAgent,
+		Version:      "ImageDescription: 0.2.18-r23-254; ImageDate: Wed Aug 29 10:49:26 EEST 2018; " + magPortalVersion,
+		HWVersion:    "2.6-IB-00",
+		ImageVersion: "218",
+	},
+	"mag322": {
+		STBType:      "MAG322",
+		UserAgent:    magWebKitAgent,
+		Version:      "ImageDescription: 0.2.18-r23-322; ImageDate: Wed Aug 29 11:01:56 EEST 2018; " + magPortalVersion,
+		HWVersion:    "1.0-BD-00",
+		ImageVersion: "218",
+	},
+	"mag424": {
+		STBType:      "MAG424",
+		UserAgent:    magWebKitAgent,
+		Version:      "ImageDescription: 0.2.18-r24-424; ImageDate: Tue Mar 17 16:28:33 EET 2020; " + magPortalVersion,
+		HWVersion:    "1.0-BD-00",
+		ImageVersion: "218",
+	},
+	"aurahd": {
+		STBType:      "AuraHD",
+		UserAgent:    mag200UserAgent,
+		Version:      "ImageDescription: 0.2.18-r14-pub-250; ImageDate: Fri Jan 15 15:20:44 EET 2016; " + mag250PortalVer,
+		HWVersion:    "1.7-BD-00",
+		ImageVersion: "218",
+	},
+	"infomir_web": {
+		STBType:      "MAG250",
+		UserAgent:    defaultUserAgent,
+		Version:      infomirWebVersion,
+		HWVersion:    "1.0-BD-00",
+		ImageVersion: "218",
+		Browser:      true,
+	},
+	"browser": {
+		UserAgent:    defaultUserAgent,
+		Version:      infomirWebVersion,
+		HWVersion:    "1.0-BD-00",
+		ImageVersion: "218",
+		Browser:      true,
+	},
+}
+
+func init() {
+	for name, d := range devices {
+		d.Name = name
+		devices[name] = d
+	}
+}
+
+// DeviceNames returns names of all device profiles.
+func DeviceNames() []string {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectDevice picks device profile of the portal. If it's not configured, browser profile is used when custom
+// User-Agent is set (most likely for Cloudflare), otherwise the profile of configured model. Unknown models look like
+// MAG250 with their own model name.
+func (p *Portal) selectDevice() error {
+	name := strings.ToLower(p.DeviceName)
+	if name == "" {
+		if p.UserAgent != "" {
+			name = "browser"
+		} else {
+			name = strings.ToLower(p.Model)
+		}
+	}
+
+	d, found := devices[name]
+	if !found {
+		if p.DeviceName != "" {
+			return errors.New("unknown device '" + p.DeviceName + "' (known devices: " + strings.Join(DeviceNames(), ", ") + ")")
+		}
+		d = devices["mag250"]
+		d.Name = "mag250"
+		d.STBType = p.Model
+	}
+	if d.STBType == "" {
+		d.STBType = p.Model
+	}
+	if p.UserAgent != "" {
+		d.UserAgent = p.UserAgent
+	}
+	p.device = d
+	return nil
+}
+
+// Device returns device profile of the portal.
+func (p *Portal) Device() Device {
+	return p.device
+}
+
+// xUserAgent returns value of 'X-User-Agent' header.
+func (d Device) xUserAgent() string {
+	return "Model: " + d.STBType + "; Link: Ethernet"
+}
+
+// clientReferer returns link to Stalker web client, which STBs send as 'Referer' to portal API.
+func clientReferer(location string) string {
+	return portalRoot(location) + "c/"
+}
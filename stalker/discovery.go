@@ -0,0 +1,178 @@
+package stalker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Flavours of Stalker portal API.
+const (
+	FlavourStalker = "stalker"    // '.../server/load.php' of Stalker/Ministra middleware
+	FlavourPortal  = "portal.php" // '.../portal.php', used by Stalker API emulating middlewares
+)
+
+// endpointCandidate is a link to probe for portal API.
+type endpointCandidate struct {
+	path, flavour string
+}
+
+// reClientEndpoint finds API endpoint in Stalker web client's 'xpcom.common.js', e.g. '/server/load.php'.
+var reClientEndpoint = regexp.MustCompile(`['"]([\w./-]*(?:load|portal)\.php)['"]`)
+
+// Endpoint returns link to portal API that is in use. It's the configured one, unless it was discovered.
+func (p *Portal) Endpoint() string {
+	p.sessionMux.RLock()
+	defer p.sessionMux.RUnlock()
+	if p.endpoint == "" {
+		return p.Location
+	}
+	return p.endpoint
+}
+
+func (p *Portal) setEndpoint(link string) {
+	p.sessionMux.Lock()
+	p.endpoint = link
+	p.sessionMux.Unlock()
+}
+
+// Flavour returns flavour of portal API, if it was discovered.
+func (p *Portal) Flavour() string {
+	p.stateMux.Lock()
+	defer p.stateMux.Unlock()
+	return p.state.Flavour
+}
+
+// needsDiscovery returns true if API endpoint was not discovered yet and configured portal URL might not be one, e.g.
+// it's a bare host or link to web client.
+func (p *Portal) needsDiscovery() bool {
+	if p.Flavour() != "" {
+		return false
+	}
+	u, err := url.Parse(p.Endpoint())
+	return err == nil && !strings.HasSuffix(u.Path, ".php")
+}
+
+// discover probes configured portal URL and then known layouts of Stalker portals, and switches to the API endpoint
+// that answers handshake.
+func (p *Portal) discover() error {
+	configured := p.Location
+	base, err := url.Parse(configured)
+	if err != nil {
+		return err
+	}
+
+	// Path where portal is installed, without web client's directory
+	prefix := strings.TrimSuffix(strings.TrimSuffix(base.Path, "/"), "/c")
+	prefixes := []string{prefix}
+	if prefix != "" {
+		prefixes = append(prefixes, "")
+	}
+
+	try := func(c endpointCandidate) bool {
+		link := *base
+		link.Path = c.path
+		link.RawQuery = ""
+		link.Fragment = ""
+		if !p.answersHandshake(link.String()) {
+			return false
+		}
+		log.Println("Discovered Stalker portal API at " + link.String() + " (" + c.flavour + ")")
+		p.setEndpoint(link.String())
+		p.stateMux.Lock()
+		p.state.Endpoint = link.String()
+		p.state.Flavour = c.flavour
+		p.state.DiscoveredFrom = configured
+		p.stateMux.Unlock()
+		return true
+	}
+
+	// Some portals answer at the configured path itself
+	if try(endpointCandidate{base.Path, flavourOf(base.Path)}) {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		// Well-known layouts first, then the endpoint that web client uses
+		for _, c := range []endpointCandidate{
+			{prefix + "/server/load.php", FlavourStalker},
+			{prefix + "/stalker_portal/server/load.php", FlavourStalker},
+			{prefix + "/portal.php", FlavourPortal},
+		} {
+			if try(c) {
+				return nil
+			}
+		}
+		for _, client := range []string{prefix + "/c/", prefix + "/stalker_portal/c/"} {
+			if endpoint, found := p.clientEndpoint(base, client); found && try(endpointCandidate{endpoint, flavourOf(endpoint)}) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no Stalker portal API found at '" + configured + "'")
+}
+
+// clientEndpoint returns API endpoint that Stalker web client in the given directory uses.
+func (p *Portal) clientEndpoint(base *url.URL, dir string) (string, bool) {
+	link := *base
+	link.Path = dir + "xpcom.common.js"
+	link.RawQuery = ""
+	link.Fragment = ""
+	content, err := p.Client().Get(context.Background(), link.String())
+	if err != nil || isHTML(content) {
+		return "", false
+	}
+	m := reClientEndpoint.FindSubmatch(content)
+	if m == nil {
+		return "", false
+	}
+	// Endpoint is relative to the directory where portal is installed
+	root := strings.TrimSuffix(dir, "c/")
+	return path.Join(root, string(m[1])), true
+}
+
+// answersHandshake returns true if link is an API endpoint that answers handshake.
+func (p *Portal) answersHandshake(link string) bool {
+	content, err := p.Client().Get(context.Background(), link+"?type=stb&action=handshake&token="+url.QueryEscape(p.SessionToken())+"&JsHttpRequest=1-xml")
+	if err != nil || isHTML(content) {
+		return false
+	}
+	var tmp struct {
+		Js map[string]interface{} `json:"js"`
+	}
+	return json.Unmarshal(content, &tmp) == nil && tmp.Js != nil
+}
+
+func flavourOf(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/portal.php") {
+		return FlavourPortal
+	}
+	return FlavourStalker
+}
+
+// portalRoot returns link to the directory where portal is installed, ending with '/', e.g.
+// 'http://example.com/stalker_portal/'. Web client, logos etc. are found there.
+func portalRoot(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return strings.TrimRight(location, "/") + "/stalker_portal/"
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	switch {
+	case strings.HasSuffix(u.Path, "/server/load.php"):
+		u.Path = strings.TrimSuffix(u.Path, "server/load.php")
+	case strings.HasSuffix(u.Path, "/portal.php"):
+		u.Path = strings.TrimSuffix(u.Path, "portal.php")
+	case strings.Contains(u.Path, "/stalker_portal/"):
+		u.Path = u.Path[:strings.Index(u.Path, "/stalker_portal/")+len("/stalker_portal/")]
+	default:
+		// Not discovered, assume the most common layout
+		u.Path = "/stalker_portal/"
+	}
+	return u.String()
+}
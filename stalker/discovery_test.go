@@ -0,0 +1,90 @@
+package stalker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPortalRoot(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/stalker_portal/server/load.php":   "http://example.com/stalker_portal/",
+		"http://example.com:8080/server/load.php?x=1":         "http://example.com:8080/",
+		"http://example.com/mag/portal.php":                   "http://example.com/mag/",
+		"http://example.com/stalker_portal/c/":                "http://example.com/stalker_portal/",
+		"http://example.com":                                  "http://example.com/stalker_portal/",
+		"http://example.com/c/":                               "http://example.com/stalker_portal/",
+		"example.com":                                         "example.com/stalker_portal/",
+		"http://example.com/custom/stalker_portal/server/api": "http://example.com/custom/stalker_portal/",
+	}
+	for location, want := range tests {
+		if got := portalRoot(location); got != want {
+			t.Errorf("portalRoot(%q) = %q, want %q", location, got, want)
+		}
+	}
+}
+
+func TestFlavourOf(t *testing.T) {
+	if f := flavourOf("/portal.php"); f != FlavourPortal {
+		t.Errorf("got %q for portal.php", f)
+	}
+	if f := flavourOf("/stalker_portal/server/load.php"); f != FlavourStalker {
+		t.Errorf("got %q for load.php", f)
+	}
+}
+
+// testPortalServer answers handshake at the given path only, and serves web client's script that points to it.
+func testPortalServer(endpoint string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case endpoint:
+			fmt.Fprint(w, `{"js":{"token":"T"}}`)
+		case "/stalker_portal/c/xpcom.common.js":
+			fmt.Fprint(w, `this.ajax_loader = this.portal_protocol + '://' + this.portal_ip + '/' + this.portal_path + '/api/v3/load.php';`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html>not found</html>")
+		}
+	}))
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		configured string // Path of configured portal URL
+		endpoint   string // Path where portal answers
+		flavour    string
+	}{
+		{"", "/stalker_portal/server/load.php", FlavourStalker},
+		{"/c/", "/server/load.php", FlavourStalker},
+		{"/mag/c/", "/mag/portal.php", FlavourPortal},
+		{"/custom/api", "/custom/api", FlavourStalker},
+		{"/stalker_portal/c/", "/stalker_portal/api/v3/load.php", FlavourStalker},
+	}
+	for _, tt := range tests {
+		srv := testPortalServer(tt.endpoint)
+		p := &Portal{Location: srv.URL + tt.configured}
+		if !p.needsDiscovery() && tt.configured != "/custom/api" {
+			t.Errorf("%q: discovery should be needed", tt.configured)
+		}
+		if err := p.discover(); err != nil {
+			t.Errorf("%q: %v", tt.configured, err)
+		} else if p.Endpoint() != srv.URL+tt.endpoint || p.Flavour() != tt.flavour {
+			t.Errorf("%q: discovered %q (%s), want %q (%s)", tt.configured, p.Endpoint(), p.Flavour(), srv.URL+tt.endpoint, tt.flavour)
+		}
+		if p.needsDiscovery() {
+			t.Errorf("%q: discovery should not be needed again", tt.configured)
+		}
+		srv.Close()
+	}
+
+	srv := testPortalServer("/nowhere")
+	defer srv.Close()
+	p := &Portal{Location: srv.URL}
+	if err := p.discover(); err == nil {
+		t.Error("discovery should fail when nothing answers handshake")
+	}
+	if p.Endpoint() != srv.URL {
+		t.Errorf("failed discovery changed endpoint to %q", p.Endpoint())
+	}
+}
@@ -0,0 +1,154 @@
+package stalker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+)
+
+// Types of events that portal pushes through watchdog.
+const (
+	EventMessage            = "send_msg"
+	EventMessageWithVideo   = "send_msg_with_video"
+	EventUpdateChannelList  = "update_channel_list"
+	EventUpdateSubscription = "update_subscription"
+	EventReboot             = "reboot"
+	EventReloadPortal       = "reload_portal"
+	EventCutOff             = "cut_off"
+	EventCutOn              = "cut_on"
+)
+
+// maxMessages is the number of portal messages that are kept.
+const maxMessages = 50
+
+// maxEventsPerUpdate limits the number of events retrieved by a single watchdog update.
+const maxEventsPerUpdate = 10
+
+// errCutOff is the error of the session while portal has cut off our account.
+var errCutOff = errors.New("service is cut off by portal")
+
+// Event is a single event that portal pushed through watchdog.
+type Event struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"event"`
+	Message     string    `json:"msg"`
+	NeedConfirm bool      `json:"need_confirm"`
+	Time        time.Time `json:"time"`
+}
+
+// OnEvent registers function that is called on every event pushed by portal, after it has been handled.
+func (p *Portal) OnEvent(f func(Event)) {
+	p.eventsMux.Lock()
+	p.eventListeners = append(p.eventListeners, f)
+	p.eventsMux.Unlock()
+}
+
+// Messages returns text messages pushed by portal, the newest first.
+func (p *Portal) Messages() []Event {
+	p.eventsMux.Lock()
+	defer p.eventsMux.Unlock()
+	messages := make([]Event, len(p.messages))
+	for i, m := range p.messages {
+		messages[len(messages)-1-i] = m
+	}
+	return messages
+}
+
+// watchdogUpdate performs watchdog update request and handles events that portal pushes with it. Portal returns
+// one event at a time, so pending ones are retrieved right away. Like firmware does, ID of the last handled event is
+// passed with the next request, so portal moves on to the next one.
+func (p *Portal) watchdogUpdate() error {
+	for i := 0; i < maxEventsPerUpdate; i++ {
+		p.eventsMux.Lock()
+		active := p.lastEventID
+		p.eventsMux.Unlock()
+		if active == "" {
+			active = "0"
+		}
+
+		var wd struct {
+			Js struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"js"`
+			Text string `json:"text"`
+		}
+		if err := p.apiRequest(p.Endpoint()+"?action=get_events&event_active_id="+url.QueryEscape(active)+"&init=0&type=watchdog&cur_play_type=1&JsHttpRequest=1-xml", &wd); err != nil {
+			return err
+		}
+
+		data := wd.Js.Data
+		event := Event{
+			ID:          jsonString(data["id"]),
+			Type:        jsonString(data["event"]),
+			Message:     jsonString(data["msg"]),
+			NeedConfirm: jsonString(data["need_confirm"]) == "1",
+			Time:        time.Now(),
+		}
+		if event.Type == "" {
+			return nil
+		}
+		// Portal did not take acknowledgement yet, don't act on the same event again
+		if event.ID != "" && event.ID == active {
+			return nil
+		}
+		p.handleEvent(event)
+		if event.ID != "" {
+			p.eventsMux.Lock()
+			p.lastEventID = event.ID
+			p.eventsMux.Unlock()
+		}
+
+		// Firmware confirms events that ask for it once they are shown or acted upon
+		if event.NeedConfirm && event.ID != "" {
+			if err := p.confirmEvent(event.ID); err != nil {
+				log.Println("Failed to confirm portal event:", err)
+			}
+		}
+		if jsonInt(data["msgs"]) <= 1 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleEvent acts on event pushed by portal and passes it to listeners.
+func (p *Portal) handleEvent(e Event) {
+	log.Println("Stalker portal event '" + e.Type + "' received")
+	switch e.Type {
+	case EventMessage, EventMessageWithVideo:
+		log.Println("Stalker portal message:", e.Message)
+		p.eventsMux.Lock()
+		p.messages = append(p.messages, e)
+		if len(p.messages) > maxMessages {
+			p.messages = p.messages[len(p.messages)-maxMessages:]
+		}
+		p.eventsMux.Unlock()
+	case EventCutOff:
+		p.setCutOff(true)
+	case EventCutOn:
+		p.setCutOff(false)
+	case EventReboot, EventReloadPortal:
+		go p.reconnect(errors.New("portal asked to " + e.Type))
+	case EventUpdateSubscription:
+		go func() {
+			if err := p.updateAccountInfo(); err != nil {
+				log.Println("Failed to retrieve account info:", err)
+			}
+		}()
+	}
+
+	p.eventsMux.Lock()
+	listeners := append([]func(Event){}, p.eventListeners...)
+	p.eventsMux.Unlock()
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// confirmEvent acknowledges event, so portal doesn't push it again.
+func (p *Portal) confirmEvent(id string) error {
+	_, err := p.Client().Get(context.Background(), p.Endpoint()+"?type=watchdog&action=confirm_event&event_active_id="+url.QueryEscape(id)+"&JsHttpRequest=1-xml")
+	return err
+}
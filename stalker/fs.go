@@ -5,9 +5,12 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
@@ -23,6 +26,13 @@ type Config struct {
 		Enabled bool   `yaml:"enabled"`
 		Bind    string `yaml:"bind"`
 		Rewrite bool   `yaml:"rewrite"`
+		// Actions overrides how emulated portal actions (handshake, watchdog, log, do_auth, logout, create_link) are
+		// answered: "fake", "pass" (to the portal) or "cache" (pass once, then answer with the cached response, not
+		// supported by watchdog and create_link).
+		Actions map[string]string `yaml:"actions"`
+		Access  ProxyAccess       `yaml:"access"`
+		Cache   ProxyCache        `yaml:"cache"`
+		Rules   ProxyRules        `yaml:"rules"`
 	} `yaml:"proxy"`
     // Admin section describes settings for the built‑in web administration UI.
     // When enabled the application will start a simple HTTP server that exposes
@@ -34,6 +44,66 @@ type Config struct {
         Enabled bool   `yaml:"enabled"`
         Bind    string `yaml:"bind"`
     } `yaml:"admin"`
+	DLNA struct {
+		Enabled      bool   `yaml:"enabled"`
+		Bind         string `yaml:"bind"`
+		FriendlyName string `yaml:"friendly_name"` // Server name shown on TVs
+	} `yaml:"dlna"`
+	STRM struct {
+		Enabled  bool   `yaml:"enabled"`
+		Dir      string `yaml:"dir"`      // Directory where .strm files are written
+		BaseURL  string `yaml:"base_url"` // HLS service address as seen by media server, e.g. http://192.168.1.10:9999
+		NFO      bool   `yaml:"nfo"`      // Write .nfo sidecar files
+		Interval int    `yaml:"interval"` // Minutes between exports. 0 means export only once on startup
+	} `yaml:"strm"`
+	Emulator struct {
+		Enabled   bool   `yaml:"enabled"`
+		Bind      string `yaml:"bind"`
+		M3U       string `yaml:"m3u"`        // Path or link to M3U playlist
+		XMLTV     string `yaml:"xmltv"`      // Path or link to XMLTV guide. Defaults to playlist's 'url-tvg'
+		ClientDir string `yaml:"client_dir"` // Directory with Stalker web client (contents of 'c/'), served to STBs
+	} `yaml:"emulator"`
+	CustomChannels []CustomChannel `yaml:"custom_channels"` // Channels from other sources, shown next to portal channels
+}
+
+// CustomChannel describes a channel that is not provided by Stalker portal.
+type CustomChannel struct {
+	Title string `yaml:"title"`
+	Genre string `yaml:"genre"` // Genre title. Portal genre with the same title is reused
+	Logo  string `yaml:"logo"`  // Full link to logo
+	URL   string `yaml:"url"`   // Stream link
+}
+
+// ProxyAccess restricts which STBs may use the proxy service. If nothing is configured, everyone is allowed.
+type ProxyAccess struct {
+	AllowMACs  []string      `yaml:"allow_macs"`  // Allowed MACs or serial numbers
+	AllowCIDRs []string      `yaml:"allow_cidrs"` // Allowed client IP ranges, e.g. 192.168.1.0/24
+	Clients    []ProxyClient `yaml:"clients"`     // Allowed STBs with individual settings
+}
+
+// ProxyClient describes settings of a single STB that is allowed to use the proxy service. If neither genres nor
+// channels are set, STB sees all channels.
+type ProxyClient struct {
+	MAC      string   `yaml:"mac"`      // MAC or serial number
+	Secret   string   `yaml:"secret"`   // If set, STB must send it in 'stalkerhek_secret' cookie
+	Genres   []string `yaml:"genres"`   // Allowed genre titles or IDs, with all their channels
+	Channels []string `yaml:"channels"` // Allowed channel titles or IDs, in addition to the ones of allowed genres
+}
+
+// ProxyCache configures caching of heavy portal API responses in the proxy service.
+type ProxyCache struct {
+	Enabled              bool           `yaml:"enabled"`
+	TTL                  map[string]int `yaml:"ttl"`                    // Seconds to cache responses of each action. 0 disables caching of the action
+	StaleWhileRevalidate bool           `yaml:"stale_while_revalidate"` // Serve expired responses while refreshing them in background
+}
+
+// ProxyRules describes how portal responses are modified before they are sent to STBs.
+type ProxyRules struct {
+	HideChannels   []string          `yaml:"hide_channels"`   // Channel titles or IDs
+	HideGenres     []string          `yaml:"hide_genres"`     // Genre titles or IDs. Their channels are hidden too
+	RenameChannels map[string]string `yaml:"rename_channels"` // Channel title or ID -> new title
+	RenameGenres   map[string]string `yaml:"rename_genres"`   // Genre title or ID -> new title
+	MainInfo       map[string]string `yaml:"main_info"`       // Fields of 'get_main_info' response to set
 }
 
 // Portal represents Stalker portal
@@ -65,6 +135,31 @@ type Portal struct {
     // "cf_clearance=longvalue").  The cookie is appended to the
     // internally generated cookies.
     Cookies string `yaml:"cookies"`
+
+	DeviceName string `yaml:"device"` // Device profile, see DeviceNames()
+	device     Device
+
+	token      string // Token of the current session. Token is only the configured one
+	endpoint   string // API endpoint in use, discovered or restored from state. Location is only the configured one
+	random     string // Issued by portal in handshake
+	sessionMux sync.RWMutex // Protects token, endpoint and random
+	profile    Profile
+	account    AccountInfo
+	profileMux sync.Mutex // Protects profile and account
+
+	StateFile      string `yaml:"state_file"`      // Where session and channels are kept between restarts. Empty disables it
+	ChannelRefresh int    `yaml:"channel_refresh"` // Minutes between channel list refreshes. 0 disables them
+	state     savedState
+	stateMux  sync.Mutex
+
+	messages       []Event // Text messages pushed by portal
+	eventListeners []func(Event)
+	lastEventID    string // Passed to portal as 'event_active_id' to acknowledge the last event
+	eventsMux      sync.Mutex
+
+	session    supervisor // State of our session with the portal
+	client     *Client    // HTTP client shared by everything that talks to the portal
+	clientOnce sync.Once
 }
 
 // ReadConfig returns configuration from the file in Portal object
@@ -90,12 +185,33 @@ var regexMAC = regexp.MustCompile(`^[A-F0-9]{2}:[A-F0-9]{2}:[A-F0-9]{2}:[A-F0-9]
 var regexTimezone = regexp.MustCompile(`^[a-zA-Z]+/[a-zA-Z]+$`)
 
 func (c *Config) validateWithDefaults() error {
+	if c.Emulator.Enabled {
+		if c.Emulator.Bind == "" {
+			return errors.New("empty emulator bind")
+		}
+		if c.Emulator.M3U == "" {
+			return errors.New("empty emulator m3u")
+		}
+	}
+
+	// Portal emulator is the only service that works without Stalker portal
+	if c.Portal == nil {
+		if !c.Emulator.Enabled || c.HLS.Enabled || c.Proxy.Enabled || c.Admin.Enabled || c.DLNA.Enabled || c.STRM.Enabled {
+			return errors.New("empty portal section (only 'emulator' can run without it)")
+		}
+		return nil
+	}
+
 	c.Portal.MAC = strings.ToUpper(c.Portal.MAC)
 
 	if c.Portal.Model == "" {
 		return errors.New("empty model")
 	}
 
+	if err := c.Portal.selectDevice(); err != nil {
+		return err
+	}
+
 	if c.Portal.SerialNumber == "" {
 		return errors.New("empty serial number (sn)")
 	}
@@ -134,7 +250,7 @@ func (c *Config) validateWithDefaults() error {
     // own is not enough to provide IPTV streams or proxy functionality, so
     // ensure either the HLS or the Proxy service is turned on.  Admin may
     // optionally be enabled alongside those services.
-    if !c.HLS.Enabled && !c.Proxy.Enabled && !c.Admin.Enabled {
+    if !c.HLS.Enabled && !c.Proxy.Enabled && !c.Admin.Enabled && !c.Emulator.Enabled {
         return errors.New("no services enabled")
     }
 
@@ -150,6 +266,47 @@ func (c *Config) validateWithDefaults() error {
 		return errors.New("HLS service must be enabled for 'proxy: rewrite'")
 	}
 
+	if c.DLNA.Enabled {
+		if c.DLNA.Bind == "" {
+			return errors.New("empty DLNA bind")
+		}
+		if !c.HLS.Enabled {
+			return errors.New("HLS service must be enabled for 'dlna'")
+		}
+		if c.DLNA.FriendlyName == "" {
+			c.DLNA.FriendlyName = "Stalkerhek"
+		}
+	}
+
+	if c.STRM.Enabled {
+		if c.STRM.Dir == "" {
+			return errors.New("empty strm dir")
+		}
+		if !c.HLS.Enabled {
+			return errors.New("HLS service must be enabled for 'strm'")
+		}
+		if c.STRM.BaseURL == "" {
+			host, port, err := net.SplitHostPort(c.HLS.Bind)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+				return errors.New("empty strm base_url (required when HLS bind address is not a specific host)")
+			}
+			c.STRM.BaseURL = "http://" + net.JoinHostPort(host, port)
+		}
+		c.STRM.BaseURL = strings.TrimRight(c.STRM.BaseURL, "/")
+	}
+
+	for i, ch := range c.CustomChannels {
+		if ch.Title == "" {
+			return errors.New("empty title of custom channel #" + strconv.Itoa(i+1))
+		}
+		if ch.URL == "" {
+			return errors.New("empty url of custom channel '" + ch.Title + "'")
+		}
+	}
+
 	if c.Portal.Token == "" {
 		c.Portal.Token = randomToken()
 		log.Println("No token given, using random one:", c.Portal.Token)
@@ -164,8 +321,8 @@ func (c *Config) validateWithDefaults() error {
 }
 
 // normalizePortalURL converts host-only or partial inputs into a valid URL
-// with a scheme, but does not append any fixed path. The portal may redirect
-// to its preferred endpoint (e.g., /stalker_portal/server/load.php).
+// with a scheme, but does not append any fixed path. If the result is not an
+// API endpoint, it is discovered on connect (e.g., /stalker_portal/server/load.php).
 func normalizePortalURL(raw string) (string, error) {
 	uStr := strings.TrimSpace(raw)
 	if uStr == "" {
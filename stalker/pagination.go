@@ -0,0 +1,104 @@
+package stalker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of walking channel lists genre by genre: number of genres retrieved at once, minimal interval between
+// requests to the portal and maximal number of pages of a single genre.
+const (
+	pageWorkers  = 4
+	pageInterval = 200 * time.Millisecond
+	maxPages     = 500
+)
+
+// retrieveChannelsByGenre retrieves channels with 'get_ordered_list', walking all pages of every genre. Genres that
+// fail are skipped; error is returned only if nothing was retrieved.
+func (p *Portal) retrieveChannelsByGenre(genres map[string]string) ([]portalChannel, error) {
+	ids := make([]string, 0, len(genres))
+	for id := range genres {
+		// '*' lists everything, but portals that cap channel lists tend to cap it as well
+		if id != "*" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, "*")
+	}
+
+	limiter := time.NewTicker(pageInterval)
+	defer limiter.Stop()
+
+	jobs := make(chan string)
+	var mux sync.Mutex
+	var channels []portalChannel
+	var failed []string
+	var wg sync.WaitGroup
+	for i := 0; i < pageWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for genre := range jobs {
+				list, err := p.retrieveGenreChannels(genre, limiter.C)
+				mux.Lock()
+				channels = append(channels, list...)
+				if err != nil {
+					log.Println("Failed to retrieve channels of genre '"+genres[genre]+"':", err)
+					failed = append(failed, genre)
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(channels) == 0 && len(failed) != 0 {
+		return nil, errors.New("failed to retrieve channels of " + strconv.Itoa(len(failed)) + " genres")
+	}
+	return channels, nil
+}
+
+// retrieveGenreChannels retrieves all pages of the genre, waiting for limiter before each request.
+func (p *Portal) retrieveGenreChannels(genre string, limiter <-chan time.Time) ([]portalChannel, error) {
+	type tmpStruct struct {
+		Js struct {
+			TotalItems   interface{}     `json:"total_items"`
+			MaxPageItems interface{}     `json:"max_page_items"`
+			Data         []portalChannel `json:"data"`
+		} `json:"js"`
+	}
+
+	var channels []portalChannel
+	for page := 1; page <= maxPages; page++ {
+		<-limiter
+		var tmp tmpStruct
+		link := p.Endpoint() + "?type=itv&action=get_ordered_list&genre=" + url.QueryEscape(genre) + "&fav=0&sortby=number&p=" + strconv.Itoa(page) + "&JsHttpRequest=1-xml"
+		// A single failed page is not a reason to re-establish the session, so failures are not reported here
+		content, err := p.Client().Get(context.Background(), link)
+		if err != nil {
+			return channels, err
+		}
+		if err = json.Unmarshal(content, &tmp); err != nil {
+			return channels, errors.New("unexpected portal response: " + truncate(string(content), 200))
+		}
+		channels = append(channels, tmp.Js.Data...)
+
+		total := jsonInt(tmp.Js.TotalItems)
+		perPage := jsonInt(tmp.Js.MaxPageItems)
+		if len(tmp.Js.Data) == 0 || perPage <= 0 || page*perPage >= total {
+			break
+		}
+	}
+	return channels, nil
+}
@@ -0,0 +1,147 @@
+package stalker
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile describes our account, as returned by 'get_profile'.
+type Profile struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Status          int       `json:"status"` // 0 means account is active
+	Blocked         bool      `json:"blocked"`
+	TariffPlan      string    `json:"tariff_plan"`
+	TariffPlanID    string    `json:"tariff_plan_id"`
+	WatchdogTimeout int       `json:"watchdog_timeout"` // Seconds after which portal considers STB to be offline, if it does not send watchdog events
+	Updated         time.Time `json:"updated"`
+}
+
+// minKeepAliveInterval limits how often watchdog events are sent, whatever portal asks for.
+const minKeepAliveInterval = 10 * time.Second
+
+// Profile returns profile of our account, retrieved with the last handshake.
+func (p *Portal) Profile() Profile {
+	p.profileMux.Lock()
+	defer p.profileMux.Unlock()
+	return p.profile
+}
+
+// getProfile requests profile the same way STB firmware does after handshake and stores it. authSecondStep tells
+// portal that we are already authenticated (or want to be authenticated by device IDs).
+func (p *Portal) getProfile(authSecondStep bool) error {
+	d := p.device
+	p.sessionMux.RLock()
+	random := p.random
+	p.sessionMux.RUnlock()
+	metrics, _ := json.Marshal(map[string]string{
+		"mac":    p.MAC,
+		"sn":     p.SerialNumber,
+		"type":   "STB",
+		"model":  d.STBType,
+		"uid":    p.DeviceID,
+		"random": random,
+	})
+	prehash := sha1.Sum([]byte(p.SerialNumber + p.MAC))
+
+	query := url.Values{}
+	query.Set("type", "stb")
+	query.Set("action", "get_profile")
+	query.Set("hd", "1")
+	query.Set("ver", d.Version)
+	query.Set("num_banks", "2")
+	query.Set("sn", p.SerialNumber)
+	query.Set("stb_type", d.STBType)
+	query.Set("client_type", "STB")
+	query.Set("image_version", d.ImageVersion)
+	query.Set("video_out", "hdmi")
+	query.Set("device_id", p.DeviceID)
+	query.Set("device_id2", p.DeviceID2)
+	query.Set("signature", p.Signature)
+	query.Set("auth_second_step", "0")
+	if authSecondStep {
+		query.Set("auth_second_step", "1")
+	}
+	query.Set("hw_version", d.HWVersion)
+	query.Set("not_valid_token", "0")
+	query.Set("metrics", string(metrics))
+	query.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	query.Set("api_signature", "262")
+	query.Set("prehash", strings.ToUpper(hex.EncodeToString(prehash[:])))
+	query.Set("JsHttpRequest", "1-xml")
+
+	content, err := p.Client().Get(context.Background(), p.Endpoint()+"?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	if isHTML(content) {
+		log.Println(string(content))
+		return errors.New("profile response was HTML (portal may be blocked by Cloudflare or credentials invalid)")
+	}
+
+	// Portals differ in types of these fields, so they are converted manually
+	var tmp struct {
+		Js map[string]interface{} `json:"js"`
+	}
+	if err = json.Unmarshal(content, &tmp); err != nil {
+		return errors.New("unexpected profile response: " + truncate(string(content), 200))
+	}
+	profile := Profile{
+		ID:              jsonString(tmp.Js["id"]),
+		Name:            jsonString(tmp.Js["fname"]),
+		Status:          jsonInt(tmp.Js["status"]),
+		Blocked:         jsonString(tmp.Js["blocked"]) == "1" || jsonString(tmp.Js["blocked"]) == "true",
+		TariffPlan:      jsonString(tmp.Js["tariff_plan"]),
+		TariffPlanID:    jsonString(tmp.Js["tariff_plan_id"]),
+		WatchdogTimeout: jsonInt(tmp.Js["watchdog_timeout"]),
+		Updated:         time.Now(),
+	}
+	p.profileMux.Lock()
+	p.profile = profile
+	p.profileMux.Unlock()
+
+	if profile.Blocked {
+		return errAccountBlocked
+	}
+	if p.DeviceIdAuth && profile.ID == "" {
+		return errInvalidCredentials
+	}
+	if profile.Name != "" {
+		log.Println("Authenticated as " + profile.Name)
+	}
+	return nil
+}
+
+// keepAliveInterval returns interval between watchdog events: the one portal asked for in profile, otherwise the
+// configured one.
+func (p *Portal) keepAliveInterval() time.Duration {
+	if timeout := p.Profile().WatchdogTimeout; timeout > 0 {
+		interval := time.Duration(timeout) * time.Second
+		if interval < minKeepAliveInterval {
+			interval = minKeepAliveInterval
+		}
+		return interval
+	}
+	return time.Duration(p.WatchDogTime) * time.Minute
+}
+
+// jsonString converts decoded JSON value to string. Portals are not consistent about types.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
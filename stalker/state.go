@@ -0,0 +1,177 @@
+package stalker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// savedState is what we remember about the portal between restarts.
+type savedState struct {
+	Token    string `json:"token"`
+	Endpoint string `json:"endpoint,omitempty"` // Discovered API endpoint
+	Flavour  string `json:"flavour,omitempty"`
+	// Portal URL from configuration that endpoint was discovered from. Discovery is repeated if it changes
+	DiscoveredFrom string            `json:"discovered_from,omitempty"`
+	Cookies        []savedCookie     `json:"cookies"`
+	Profile        Profile           `json:"profile"`
+	Channels       []savedChannel    `json:"channels"`
+	Genres         map[string]string `json:"genres"`
+	Saved          time.Time         `json:"saved"`
+}
+
+type savedCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type savedChannel struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	CMD      string `json:"cmd"`
+	LogoLink string `json:"logo"`
+	GenreID  string `json:"genre_id"`
+	CMDID    string `json:"cmd_id"`
+	CMDChID  string `json:"cmd_ch_id"`
+}
+
+// LoadState restores token, cookies and profile of the previous session from state file and returns channels that
+// were retrieved the last time. Returned channels are empty if state file is not configured or does not exist yet.
+func (p *Portal) LoadState() (map[string]*Channel, error) {
+	if p.StateFile == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(p.StateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err = json.Unmarshal(content, &state); err != nil {
+		return nil, err
+	}
+
+	if state.Token != "" {
+		p.sessionMux.Lock()
+		p.token = state.Token
+		p.sessionMux.Unlock()
+	}
+	if state.Endpoint != "" && (state.DiscoveredFrom == p.Location || state.Endpoint == p.Location) {
+		p.setEndpoint(state.Endpoint)
+	} else {
+		state.Endpoint, state.Flavour, state.DiscoveredFrom = "", "", ""
+	}
+	if u, err := url.Parse(p.Endpoint()); err == nil && len(state.Cookies) != 0 {
+		cookies := make([]*http.Cookie, 0, len(state.Cookies))
+		for _, c := range state.Cookies {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/"})
+		}
+		p.Client().http.Jar.SetCookies(u, cookies)
+	}
+
+	p.profileMux.Lock()
+	p.profile = state.Profile
+	p.profileMux.Unlock()
+
+	genres := state.Genres
+	if genres == nil {
+		genres = make(map[string]string)
+	}
+	channels := make(map[string]*Channel, len(state.Channels))
+	for _, c := range state.Channels {
+		channels[c.Title] = &Channel{
+			ID:        c.ID,
+			Title:     c.Title,
+			CMD:       c.CMD,
+			LogoLink:  c.LogoLink,
+			Portal:    p,
+			GenreID:   c.GenreID,
+			Genres:    &genres,
+			CMD_ID:    c.CMDID,
+			CMD_CH_ID: c.CMDChID,
+		}
+	}
+
+	p.stateMux.Lock()
+	p.state = state
+	p.stateMux.Unlock()
+	return channels, nil
+}
+
+// RememberChannels saves channels retrieved from the portal to state file, so they can be served after restart even
+// if the portal is unavailable. Custom channels are not saved, as they come from configuration.
+func (p *Portal) RememberChannels(channels map[string]*Channel) error {
+	if p.StateFile == "" {
+		return nil
+	}
+	saved := make([]savedChannel, 0, len(channels))
+	var genres map[string]string
+	for _, c := range channels {
+		if c.IsCustom() {
+			continue
+		}
+		if genres == nil && c.Genres != nil {
+			genres = *c.Genres
+		}
+		saved = append(saved, savedChannel{
+			ID:       c.ID,
+			Title:    c.Title,
+			CMD:      c.CMD,
+			LogoLink: c.LogoLink,
+			GenreID:  c.GenreID,
+			CMDID:    c.CMD_ID,
+			CMDChID:  c.CMD_CH_ID,
+		})
+	}
+
+	p.stateMux.Lock()
+	defer p.stateMux.Unlock()
+	p.state.Channels = saved
+	p.state.Genres = make(map[string]string, len(genres))
+	for id, title := range genres {
+		p.state.Genres[id] = title
+	}
+	return p.writeState()
+}
+
+// rememberSession saves token, cookies and profile of the established session to state file.
+func (p *Portal) rememberSession() error {
+	if p.StateFile == "" {
+		return nil
+	}
+	var cookies []savedCookie
+	if u, err := url.Parse(p.Endpoint()); err == nil {
+		for _, c := range p.Client().http.Jar.Cookies(u) {
+			cookies = append(cookies, savedCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	profile := p.Profile()
+	token := p.SessionToken()
+
+	p.stateMux.Lock()
+	defer p.stateMux.Unlock()
+	p.state.Token = token
+	p.state.Cookies = cookies
+	p.state.Profile = profile
+	return p.writeState()
+}
+
+// writeState writes state to a temporary file and then renames it, so state file is never left half-written.
+// Caller must hold stateMux.
+func (p *Portal) writeState() error {
+	p.state.Saved = time.Now()
+	content, err := json.MarshalIndent(p.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.StateFile)
+}
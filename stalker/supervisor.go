@@ -0,0 +1,267 @@
+package stalker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// SessionState describes state of our session with Stalker portal.
+type SessionState int
+
+// States of session with Stalker portal.
+const (
+	StateHandshaking   SessionState = iota // Reserving token and authenticating
+	StateAuthenticated                     // Session works
+	StateDegraded                          // Portal calls fail, session is being re-established in background
+	StateBlocked                           // Portal rejects our account, retrying with the longest backoff
+	StateCutOff                            // Portal has cut off our service, until it pushes 'cut_on' event
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case StateHandshaking:
+		return "handshaking"
+	case StateAuthenticated:
+		return "authenticated"
+	case StateDegraded:
+		return "degraded"
+	case StateCutOff:
+		return "cut off"
+	default:
+		return "blocked"
+	}
+}
+
+// StateChange describes transition of session state.
+type StateChange struct {
+	From, To SessionState
+	Err      error // Error that caused transition, if any
+	Time     time.Time
+}
+
+// Delays between attempts to re-establish session.
+const (
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// errInvalidCredentials is returned when portal does not accept our account.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// errAccountBlocked is returned when portal reports our account as blocked.
+var errAccountBlocked = errors.New("account is blocked by portal")
+
+// errCloudflareChallenge is wrapped by errors of requests that Cloudflare (or another WAF) refuses to pass to portal.
+var errCloudflareChallenge = errors.New("cloudflare challenge detected")
+
+// supervisor keeps track of session state and re-establishes session when it breaks.
+type supervisor struct {
+	mux        sync.Mutex
+	state      SessionState
+	err        error     // Last error
+	since      time.Time // When current state was entered
+	listeners  []func(StateChange)
+	recovering bool // Background recovery is running
+	cutOff     bool // Portal has cut off our service
+
+	connectMux sync.Mutex // Only one handshake at a time
+}
+
+// State returns current session state, when it was entered and the last error.
+func (p *Portal) State() (SessionState, time.Time, error) {
+	p.session.mux.Lock()
+	defer p.session.mux.Unlock()
+	return p.session.state, p.session.since, p.session.err
+}
+
+// OnStateChange registers function that is called on every session state change.
+func (p *Portal) OnStateChange(f func(StateChange)) {
+	p.session.mux.Lock()
+	p.session.listeners = append(p.session.listeners, f)
+	p.session.mux.Unlock()
+}
+
+func (p *Portal) setState(state SessionState, err error) {
+	p.session.mux.Lock()
+	change := StateChange{From: p.session.state, To: state, Err: err, Time: time.Now()}
+	p.session.err = err
+	if change.From == change.To {
+		p.session.mux.Unlock()
+		return
+	}
+	p.session.state = state
+	p.session.since = change.Time
+	listeners := append([]func(StateChange){}, p.session.listeners...)
+	p.session.mux.Unlock()
+
+	for _, f := range listeners {
+		f(change)
+	}
+}
+
+// connect reserves token, authenticates with credentials, if configured, and retrieves profile of our account. With
+// device ID authentication, profile request is what authenticates us.
+func (p *Portal) connect() error {
+	if p.needsDiscovery() {
+		if err := p.discover(); err != nil {
+			return err
+		}
+	}
+	if err := p.handshake(); err != nil {
+		return err
+	}
+	loggedIn := false
+	if p.Username != "" && p.Password != "" {
+		if err := p.authenticate(); err != nil {
+			return err
+		}
+		loggedIn = true
+	}
+	if err := p.getProfile(loggedIn || p.DeviceIdAuth); err != nil {
+		return err
+	}
+	if err := p.rememberSession(); err != nil {
+		log.Println("Failed to save state file:", err)
+	}
+	return nil
+}
+
+// reconnect re-establishes session right away. If it fails, session keeps being re-established in background.
+func (p *Portal) reconnect(cause error) error {
+	started := time.Now()
+
+	p.session.connectMux.Lock()
+	defer p.session.connectMux.Unlock()
+
+	// Somebody else has already re-established session while we were waiting
+	if state, since, _ := p.State(); state == StateAuthenticated && since.After(started) {
+		return nil
+	}
+
+	log.Println("Re-establishing session with Stalker portal:", cause)
+	p.setState(StateHandshaking, cause)
+	if err := p.connect(); err != nil {
+		if isBlocked(err) {
+			p.setState(StateBlocked, err)
+		} else {
+			p.setState(StateDegraded, err)
+		}
+		p.startRecovery()
+		return err
+	}
+	p.setAuthenticated()
+	return nil
+}
+
+// setAuthenticated marks session as working, unless portal has cut off our service.
+func (p *Portal) setAuthenticated() {
+	p.session.mux.Lock()
+	cutOff := p.session.cutOff
+	p.session.mux.Unlock()
+	if cutOff {
+		p.setState(StateCutOff, errCutOff)
+		return
+	}
+	p.setState(StateAuthenticated, nil)
+}
+
+// setCutOff marks whether portal has cut off our service.
+func (p *Portal) setCutOff(cutOff bool) {
+	p.session.mux.Lock()
+	p.session.cutOff = cutOff
+	p.session.mux.Unlock()
+	if state, _, _ := p.State(); state == StateAuthenticated || state == StateCutOff {
+		p.setAuthenticated()
+	}
+}
+
+// reportFailure marks session as degraded and starts re-establishing it in background.
+func (p *Portal) reportFailure(err error) {
+	if state, _, _ := p.State(); state == StateAuthenticated {
+		p.setState(StateDegraded, err)
+	}
+	p.startRecovery()
+}
+
+// startRecovery re-establishes session in background with exponential backoff, unless it's already being done.
+func (p *Portal) startRecovery() {
+	p.session.mux.Lock()
+	if p.session.recovering {
+		p.session.mux.Unlock()
+		return
+	}
+	p.session.recovering = true
+	p.session.mux.Unlock()
+
+	go func() {
+		defer func() {
+			p.session.mux.Lock()
+			p.session.recovering = false
+			p.session.mux.Unlock()
+		}()
+
+		delay := minReconnectDelay
+		for {
+			state, _, err := p.State()
+			if state == StateBlocked {
+				delay = maxReconnectDelay
+			}
+			time.Sleep(delay)
+			if err == nil {
+				err = errors.New("session broke")
+			}
+			if p.reconnect(err) == nil {
+				log.Println("Session with Stalker portal re-established")
+				return
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}()
+}
+
+// isBlocked returns true if error means that portal rejects our account, so retrying soon won't help.
+func isBlocked(err error) bool {
+	return errors.Is(err, errInvalidCredentials) || errors.Is(err, errAccountBlocked) || errors.Is(err, errCloudflareChallenge)
+}
+
+// apiRequest performs portal API request and decodes its JSON response into v. Failures are reported to session
+// supervisor.
+func (p *Portal) apiRequest(link string, v interface{}) error {
+	content, err := p.Client().Get(context.Background(), link)
+	if err != nil {
+		p.reportFailure(err)
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		err = errors.New("unexpected portal response: " + truncate(string(content), 200))
+		p.reportFailure(err)
+		return err
+	}
+	return nil
+}
+
+// getJSON performs API request like apiRequest does, but doesn't report failures to session supervisor. It's meant
+// for requests whose failure does not mean that the session is broken.
+func (p *Portal) getJSON(link string, v interface{}) error {
+	content, err := p.Client().Get(context.Background(), link)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return errors.New("unexpected portal response: " + truncate(string(content), 200))
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,26 @@
+package stalker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsBlocked(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errInvalidCredentials, true},
+		{errAccountBlocked, true},
+		{fmt.Errorf("%w: set portal.cookies", errCloudflareChallenge), true},
+		{fmt.Errorf("failed to authenticate: %w", errInvalidCredentials), true},
+		{errors.New("authentication response was HTML (portal may be blocked by Cloudflare or credentials invalid)"), false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isBlocked(tt.err); got != tt.want {
+			t.Errorf("isBlocked(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
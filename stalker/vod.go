@@ -0,0 +1,186 @@
+package stalker
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VOD stores information about movie or series in Stalker portal video library.
+type VOD struct {
+	ID          string
+	Name        string
+	Year        string
+	Description string
+	Poster      string // Full link to poster image
+	CMD         string // VOD's identifier in Stalker portal, used to request a playable link
+	Category    string // Category title
+	Series      []int  // Episode numbers. Empty for movies.
+	Show        string // Title of series without season, e.g. 'Name' of 'Name - Season 2'. Same as Name for movies.
+	Season      int    // Season number of series. 1 if title does not tell.
+	Portal      *Portal
+}
+
+// reSeason finds season number at the end of series title, e.g. 'Name S02', 'Name - Season 2', 'Name (Сезон 2)'.
+var reSeason = regexp.MustCompile(`(?i)^(.+?)[\s.,:(\[-]+(?:season|сезон|s)\s*0*(\d{1,3})[)\]]?$`)
+
+// IsSeries returns true if VOD item has episodes.
+func (v *VOD) IsSeries() bool {
+	return len(v.Series) != 0
+}
+
+// RetrieveVOD retrieves all movies and series from stalker portal video library. If some categories fail, items of
+// the other ones are returned together with an error, so callers can tell that the library is incomplete. Failures
+// are not reported to session supervisor, as the library is walked in the background.
+func (p *Portal) RetrieveVOD() ([]*VOD, error) {
+	categories, err := p.getVODCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	vods := make([]*VOD, 0)
+	failed := 0
+	for _, category := range categories {
+		for page := 1; ; page++ {
+			items, totalPages, err := p.getVODPage(category, page)
+			if err != nil {
+				log.Println("Failed to retrieve VOD category '"+category.Title+"':", err)
+				failed++
+				break
+			}
+			for _, v := range items {
+				if seen[v.ID] {
+					continue
+				}
+				seen[v.ID] = true
+				vods = append(vods, v)
+			}
+			if page >= totalPages {
+				break
+			}
+		}
+	}
+	if failed != 0 {
+		return vods, errors.New("failed to retrieve " + strconv.Itoa(failed) + " of " + strconv.Itoa(len(categories)) + " VOD categories")
+	}
+	return vods, nil
+}
+
+type vodCategory struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+func (p *Portal) getVODCategories() ([]vodCategory, error) {
+	type tmpStruct struct {
+		Js []vodCategory `json:"js"`
+	}
+	var tmp tmpStruct
+
+	if err := p.getJSON(p.Endpoint()+"?type=vod&action=get_categories&JsHttpRequest=1-xml", &tmp); err != nil {
+		return nil, err
+	}
+
+	categories := make([]vodCategory, 0, len(tmp.Js))
+	for _, c := range tmp.Js {
+		// '*' is a pseudo category that lists everything, which some portals do not support
+		if c.ID != "*" {
+			categories = append(categories, c)
+		}
+	}
+	return categories, nil
+}
+
+func (p *Portal) getVODPage(category vodCategory, page int) ([]*VOD, int, error) {
+	type tmpStruct struct {
+		Js struct {
+			TotalItems   interface{} `json:"total_items"`
+			MaxPageItems interface{} `json:"max_page_items"`
+			Data         []struct {
+				ID          json.Number   `json:"id"`
+				Name        string        `json:"name"`
+				Year        interface{}   `json:"year"`
+				Description string        `json:"description"`
+				Screenshot  string        `json:"screenshot_uri"`
+				Cmd         string        `json:"cmd"`
+				Series      []json.Number `json:"series"`
+			} `json:"data"`
+		} `json:"js"`
+	}
+	var tmp tmpStruct
+
+	link := p.Endpoint() + "?type=vod&action=get_ordered_list&category=" + url.QueryEscape(category.ID) + "&sortby=added&p=" + strconv.Itoa(page) + "&JsHttpRequest=1-xml"
+	if err := p.getJSON(link, &tmp); err != nil {
+		return nil, 0, err
+	}
+
+	vods := make([]*VOD, 0, len(tmp.Js.Data))
+	for _, d := range tmp.Js.Data {
+		v := &VOD{
+			ID:          d.ID.String(),
+			Name:        strings.TrimSpace(d.Name),
+			Description: strings.TrimSpace(d.Description),
+			Poster:      p.absoluteLink(d.Screenshot),
+			CMD:         d.Cmd,
+			Category:    category.Title,
+			Portal:      p,
+		}
+		if year := jsonInt(d.Year); year > 0 {
+			v.Year = strconv.Itoa(year) // Ignores values such as "N/A"
+		}
+		for _, s := range d.Series {
+			if n, err := s.Int64(); err == nil && n > 0 {
+				v.Series = append(v.Series, int(n))
+			}
+		}
+		v.Show, v.Season = v.Name, 1
+		if m := reSeason.FindStringSubmatch(v.Name); m != nil && v.IsSeries() {
+			v.Show = strings.TrimSpace(m[1])
+			v.Season, _ = strconv.Atoi(m[2])
+		}
+		if v.Name == "" || v.CMD == "" {
+			continue
+		}
+		vods = append(vods, v)
+	}
+
+	total := jsonInt(tmp.Js.TotalItems)
+	perPage := jsonInt(tmp.Js.MaxPageItems)
+	if perPage <= 0 || len(tmp.Js.Data) == 0 {
+		return vods, page, nil
+	}
+	return vods, (total + perPage - 1) / perPage, nil
+}
+
+// jsonInt converts JSON number or numeric string to int. Portals are not consistent about it.
+func jsonInt(v interface{}) int {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case string:
+		i, _ := strconv.Atoi(strings.TrimSpace(n))
+		return i
+	}
+	return 0
+}
+
+// absoluteLink resolves link that is relative to portal's host.
+func (p *Portal) absoluteLink(link string) string {
+	if link == "" || strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+		return link
+	}
+	base, err := url.Parse(p.Endpoint())
+	if err != nil {
+		return link
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return base.ResolveReference(ref).String()
+}
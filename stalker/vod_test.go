@@ -0,0 +1,26 @@
+package stalker
+
+import "testing"
+
+func TestSeasonTitle(t *testing.T) {
+	tests := []struct {
+		name, show, season string
+	}{
+		{"Name S02", "Name", "2"},
+		{"Name - Season 10", "Name", "10"},
+		{"Name (Сезон 3)", "Name", "3"},
+		{"Name: season 01", "Name", "1"},
+		{"Name [S4]", "Name", "4"},
+		{"Mass Effects", "", ""},
+		{"Seasons", "", ""},
+	}
+	for _, tt := range tests {
+		m := reSeason.FindStringSubmatch(tt.name)
+		switch {
+		case tt.show == "" && m != nil:
+			t.Errorf("%q: unexpected season %q of %q", tt.name, m[2], m[1])
+		case tt.show != "" && (m == nil || m[1] != tt.show || m[2] != tt.season):
+			t.Errorf("%q: got %v, want show %q season %s", tt.name, m, tt.show, tt.season)
+		}
+	}
+}
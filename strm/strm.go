@@ -0,0 +1,254 @@
+package strm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CrazeeGhost/stalkerhek/hls"
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+// Directories (relative to configured one) that are fully managed by the export.
+const (
+	moviesDir = "Movies"
+	showsDir  = "TV Shows"
+)
+
+// Start exports VOD library once and then repeats it every configured interval.
+func Start(c *stalker.Config) {
+	for {
+		if err := Export(c); err != nil {
+			log.Println("STRM export failed:", err)
+		}
+		if c.STRM.Interval <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(c.STRM.Interval) * time.Minute)
+	}
+}
+
+// Export writes portal's movies and series into a directory tree of .strm (and optionally .nfo) files. Files of items
+// that no longer exist in portal are removed, unchanged files are left untouched. If the library could not be
+// retrieved completely, nothing is removed.
+func Export(c *stalker.Config) error {
+	log.Println("Retrieving VOD library from Stalker middleware...")
+	vods, err := c.Portal.RetrieveVOD()
+	if err != nil && len(vods) == 0 {
+		return err
+	}
+	complete := err == nil && len(vods) != 0
+	if err != nil {
+		log.Println("VOD library is incomplete, stale files are kept:", err)
+	} else if len(vods) == 0 {
+		log.Println("Portal returned empty VOD library, stale files are kept")
+	}
+
+	files := exportFiles(c, vods)
+	added, updated, err := writeFiles(files)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	if complete {
+		if removed, err = removeStale(c.STRM.Dir, files); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("STRM export finished: %d items, %d files added, %d updated, %d removed\n", len(vods), added, updated, removed)
+	return nil
+}
+
+// exportFiles returns contents of exported files by their paths.
+func exportFiles(c *stalker.Config, vods []*stalker.VOD) map[string][]byte {
+	// Names of duplicates get item ID appended, so items are sorted to keep names stable between exports
+	sort.Slice(vods, func(i, j int) bool {
+		a, b := vods[i], vods[j]
+		if a.Show != b.Show {
+			return a.Show < b.Show
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		return a.ID < b.ID
+	})
+
+	files := make(map[string][]byte)
+	used := make(map[string]bool)
+	shows := make(map[string][]string) // Directories of series by show title and year
+	seasons := make(map[string]bool)   // Seasons already exported, by directory and season number
+	for _, v := range vods {
+		name := sanitize(v.Show)
+		if v.Year != "" {
+			name += " (" + v.Year + ")"
+		}
+
+		if !v.IsSeries() {
+			// Two different items might end up with the same name
+			if used[moviesDir+"/"+name] {
+				name += " [" + v.ID + "]"
+			}
+			used[moviesDir+"/"+name] = true
+
+			dir := filepath.Join(c.STRM.Dir, moviesDir, name)
+			files[filepath.Join(dir, name+".strm")] = streamFile(c, v, 0)
+			if c.STRM.NFO {
+				files[filepath.Join(dir, name+".nfo")] = nfoFile("movie", v)
+			}
+			continue
+		}
+
+		// Seasons of the same show share its directory
+		show := name
+		name = ""
+		for _, existing := range shows[show] {
+			if !seasons[existing+"/"+strconv.Itoa(v.Season)] {
+				name = existing
+				break
+			}
+		}
+		if name == "" {
+			name = show
+			if used[showsDir+"/"+name] {
+				name += " [" + v.ID + "]"
+			}
+			used[showsDir+"/"+name] = true
+			shows[show] = append(shows[show], name)
+		}
+		seasons[name+"/"+strconv.Itoa(v.Season)] = true
+
+		dir := filepath.Join(c.STRM.Dir, showsDir, name)
+		if c.STRM.NFO {
+			if _, exists := files[filepath.Join(dir, "tvshow.nfo")]; !exists {
+				files[filepath.Join(dir, "tvshow.nfo")] = nfoFile("tvshow", v)
+			}
+		}
+		season := fmt.Sprintf("Season %02d", v.Season)
+		for _, episode := range v.Series {
+			episodeName := fmt.Sprintf("%s S%02dE%02d.strm", sanitize(v.Show), v.Season, episode)
+			files[filepath.Join(dir, season, episodeName)] = streamFile(c, v, episode)
+		}
+	}
+	return files
+}
+
+func streamFile(c *stalker.Config, v *stalker.VOD, episode int) []byte {
+	return []byte(c.STRM.BaseURL + "/vod/" + hls.StreamToken(v.CMD, episode) + "\n")
+}
+
+// nfo is a minimal Kodi/Jellyfin compatible metadata file.
+type nfo struct {
+	XMLName xml.Name
+	Title   string `xml:"title"`
+	Year    string `xml:"year,omitempty"`
+	Plot    string `xml:"plot,omitempty"`
+	Genre   string `xml:"genre,omitempty"`
+	Thumb   string `xml:"thumb,omitempty"`
+}
+
+func nfoFile(root string, v *stalker.VOD) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	enc.Encode(nfo{
+		XMLName: xml.Name{Local: root},
+		Title:   v.Name,
+		Year:    v.Year,
+		Plot:    v.Description,
+		Genre:   v.Category,
+		Thumb:   v.Poster,
+	})
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// writeFiles writes only files that are missing or have different contents.
+func writeFiles(files map[string][]byte) (added, updated int, err error) {
+	for path, content := range files {
+		old, err := os.ReadFile(path)
+		switch {
+		case err == nil && bytes.Equal(old, content):
+			continue
+		case err == nil:
+			updated++
+		case os.IsNotExist(err):
+			added++
+		default:
+			return added, updated, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return added, updated, err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return added, updated, err
+		}
+	}
+	return added, updated, nil
+}
+
+// removeStale deletes .strm and .nfo files that are not part of the export, as well as directories left empty.
+func removeStale(root string, files map[string][]byte) (int, error) {
+	removed := 0
+	for _, sub := range []string{moviesDir, showsDir} {
+		var dirs []string
+		err := filepath.Walk(filepath.Join(root, sub), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				dirs = append(dirs, path)
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			if _, keep := files[path]; keep || (ext != ".strm" && ext != ".nfo") {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		// Deepest directories first, so parents become empty as well
+		sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+		for _, dir := range dirs {
+			if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+				os.Remove(dir)
+			}
+		}
+	}
+	return removed, nil
+}
+
+var reUnsafeChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f\s]+`)
+
+// sanitize makes title usable as a file name.
+func sanitize(title string) string {
+	name := strings.TrimSpace(reUnsafeChars.ReplaceAllString(title, " "))
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "Untitled"
+	}
+	return name
+}
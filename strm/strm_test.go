@@ -0,0 +1,92 @@
+package strm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CrazeeGhost/stalkerhek/stalker"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := map[string]string{
+		"Name":             "Name",
+		"  Name: Part 2 ":  "Name Part 2",
+		"AC/DC":            "AC DC",
+		"What?...":         "What",
+		"Tab\tand\nbreaks": "Tab and breaks",
+		"???":              "Untitled",
+		"":                 "Untitled",
+	}
+	for title, want := range tests {
+		if got := sanitize(title); got != want {
+			t.Errorf("sanitize(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestExportFilesSeasons(t *testing.T) {
+	c := &stalker.Config{}
+	c.STRM.Dir = "/lib"
+	c.STRM.BaseURL = "http://hls"
+
+	vods := []*stalker.VOD{
+		{ID: "1", Name: "Show S01", Show: "Show", Season: 1, Year: "2010", CMD: "a", Series: []int{1, 2}},
+		{ID: "2", Name: "Show S02", Show: "Show", Season: 2, Year: "2010", CMD: "b", Series: []int{1}},
+		{ID: "3", Name: "Show", Show: "Show", Season: 1, Year: "2020", CMD: "c", Series: []int{1}},
+		{ID: "4", Name: "Movie", Show: "Movie", Season: 1, Year: "2000", CMD: "d"},
+		{ID: "5", Name: "Movie", Show: "Movie", Season: 1, Year: "2000", CMD: "e"},
+	}
+	files := exportFiles(c, vods)
+
+	for _, path := range []string{
+		"/lib/TV Shows/Show (2010)/Season 01/Show S01E01.strm",
+		"/lib/TV Shows/Show (2010)/Season 01/Show S01E02.strm",
+		"/lib/TV Shows/Show (2010)/Season 02/Show S02E01.strm",
+		"/lib/TV Shows/Show (2020)/Season 01/Show S01E01.strm",
+		"/lib/Movies/Movie (2000)/Movie (2000).strm",
+		"/lib/Movies/Movie (2000) [5]/Movie (2000) [5].strm",
+	} {
+		if _, found := files[filepath.FromSlash(path)]; !found {
+			t.Errorf("missing %s", path)
+		}
+	}
+	if len(files) != 6 {
+		t.Errorf("got %d files, want 6: %v", len(files), files)
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	root, err := ioutil.TempDir("", "strm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	keep := filepath.Join(root, moviesDir, "Kept", "Kept.strm")
+	stale := filepath.Join(root, moviesDir, "Gone", "Gone.strm")
+	other := filepath.Join(root, showsDir, "Show", "poster.jpg")
+	for _, path := range []string{keep, stale, other} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := removeStale(root, map[string][]byte{keep: nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Error("directory of stale file is not removed")
+	}
+	for _, path := range []string{keep, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is removed", path)
+		}
+	}
+}